@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aidtechnology/suss-workshop/cmd/tlog"
+	"github.com/bryk-io/x/cli"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Verify a certificate is included in the issuance transparency log",
+	Long: `Verify a certificate is included in the issuance transparency log
+
+The signed tree head returned by the service is verified with the key of the
+CA that issued the certificate, and the certificate is verified to be included
+in it. The last tree head seen is kept in the state file; on subsequent runs
+the service must also prove the current log is consistent with it, i.e.
+previous entries have not been modified or removed.`,
+	Example: "suss-workshop audit --cert user.crt --endpoint https://suss.example.com",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Validate parameters
+		certFile := viper.GetString("audit.cert")
+		if certFile == "" {
+			return errors.New("you need to provide the certificate to audit")
+		}
+		endpoint := viper.GetString("audit.endpoint")
+		if endpoint == "" {
+			return errors.New("you need to provide the service endpoint")
+		}
+
+		// Load certificate and issuer. If the certificate file includes
+		// its chain, the issuer is the next certificate on it
+		certPEM, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			return err
+		}
+		certs, err := parseCertificates(certPEM)
+		if err != nil {
+			return err
+		}
+		if len(certs) == 1 {
+			caPEM, err := ioutil.ReadFile(viper.GetString("audit.ca"))
+			if err != nil {
+				return err
+			}
+			ca, err := parseCertificate(caPEM)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, ca)
+		}
+		cert, issuer := certs[0], certs[1]
+
+		// Verify tree head
+		log.Println("retrieving log tree head...")
+		head := &tlog.TreeHead{}
+		if err = logRequest(fmt.Sprintf("%s/log/head", endpoint), head); err != nil {
+			return err
+		}
+		if err = verifyKeySignature(issuer.PublicKey, head.Digest(), head.Signature); err != nil {
+			return fmt.Errorf("invalid tree head signature: %s", err)
+		}
+		log.Printf("tree head verified, size: %d\n", head.Size)
+
+		// Verify inclusion
+		if err = auditInclusion(endpoint, cert, head); err != nil {
+			return err
+		}
+		log.Println("certificate included in the log")
+
+		// Verify consistency with the last tree head seen
+		state := viper.GetString("audit.state")
+		if err = auditConsistency(endpoint, state, head); err != nil {
+			return err
+		}
+		js, _ := json.MarshalIndent(head, "", "  ")
+		return ioutil.WriteFile(state, js, 0600)
+	},
+}
+
+func init() {
+	params := []cli.Param{
+		{
+			Name:      "cert",
+			Usage:     "certificate to look for in the log",
+			FlagKey:   "audit.cert",
+			ByDefault: "",
+		},
+		{
+			Name:      "endpoint",
+			Usage:     "service endpoint hosting the transparency log",
+			FlagKey:   "audit.endpoint",
+			ByDefault: "",
+		},
+		{
+			Name:      "ca",
+			Usage:     "certificate of the issuing CA, when not included with the certificate",
+			FlagKey:   "audit.ca",
+			ByDefault: "root-ca.crt",
+		},
+		{
+			Name:      "state",
+			Usage:     "file used to keep the last tree head seen",
+			FlagKey:   "audit.state",
+			ByDefault: "tlog-head.json",
+		},
+	}
+	if err := cli.SetupCommandParams(auditCmd, params); err != nil {
+		panic(err)
+	}
+	rootCmd.AddCommand(auditCmd)
+}
+
+// Verify the certificate is included in the tree.
+func auditInclusion(endpoint string, cert *x509.Certificate, head *tlog.TreeHead) error {
+	leaf := tlog.LeafHash(cert.Raw)
+	proof := &inclusionProof{}
+	url := fmt.Sprintf("%s/log/proof/inclusion?hash=%s&size=%d", endpoint, hex.EncodeToString(leaf), head.Size)
+	if err := logRequest(url, proof); err != nil {
+		return err
+	}
+	if proof.Size != head.Size {
+		return errors.New("inclusion proof doesn't match the tree head size")
+	}
+	if err := tlog.VerifyInclusion(proof.Index, proof.Size, leaf, proof.Proof, head.Root); err != nil {
+		return fmt.Errorf("invalid inclusion proof: %s", err)
+	}
+	return nil
+}
+
+// Verify the tree is consistent with the tree head in the state file, if
+// any.
+func auditConsistency(endpoint, state string, head *tlog.TreeHead) error {
+	js, err := ioutil.ReadFile(state)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	prev := &tlog.TreeHead{}
+	if err = json.Unmarshal(js, prev); err != nil {
+		return fmt.Errorf("invalid state file: %s", err)
+	}
+	if prev.Size > head.Size {
+		return fmt.Errorf("the log has shrunk since it was last audited, from %d to %d entries", prev.Size, head.Size)
+	}
+	if prev.Size == 0 {
+		return nil
+	}
+	proof := &consistencyProof{}
+	if prev.Size < head.Size {
+		url := fmt.Sprintf("%s/log/proof/consistency?first=%d&second=%d", endpoint, prev.Size, head.Size)
+		if err = logRequest(url, proof); err != nil {
+			return err
+		}
+	}
+	if err = tlog.VerifyConsistency(prev.Size, head.Size, prev.Root, head.Root, proof.Proof); err != nil {
+		return fmt.Errorf("the log is not consistent with the one seen on %s: %s",
+			time.Unix(0, prev.Timestamp*int64(time.Millisecond)).Local().Format(time.RFC822), err)
+	}
+	log.Printf("log consistent with the previous tree head, size: %d\n", prev.Size)
+	return nil
+}
+
+// Submit a request to the log and decode its response into 'v'.
+func logRequest(url string, v interface{}) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	sr := &struct {
+		Ok       bool            `json:"ok"`
+		Response json.RawMessage `json:"response"`
+	}{}
+	if err = json.Unmarshal(body, sr); err != nil {
+		return err
+	}
+	if !sr.Ok {
+		return fmt.Errorf("log request failed: %s", sr.Response)
+	}
+	return json.Unmarshal(sr.Response, v)
+}
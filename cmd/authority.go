@@ -0,0 +1,578 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Certificate authority used by the service. Certificates are issued
+// either directly by the root CA or, preferably, by an intermediate CA
+// so the root key can be kept offline.
+type authority struct {
+	cert    *x509.Certificate   // signing certificate
+	key     crypto.Signer       // signing key
+	root    *x509.Certificate   // trust anchor
+	chain   []*x509.Certificate // intermediates from 'cert' up to the root, excluding it
+	trusted []*x509.Certificate // additional trust anchors, from the trust bundle
+	conf    *caConfig
+}
+
+// Signing section of the CA configuration file.
+type caConfig struct {
+	Signing struct {
+		Default  *signingProfile            `json:"default"`
+		Profiles map[string]*signingProfile `json:"profiles"`
+	} `json:"signing"`
+}
+
+// Settings used when issuing certificates with a given profile.
+type signingProfile struct {
+	Expiry       string   `json:"expiry"`
+	Usage        []string `json:"usage"`
+	Usages       []string `json:"usages"`
+	IssuerURLs   []string `json:"issuer_urls"`
+	CRL          string   `json:"crl_url"`
+	OCSP         string   `json:"ocsp_url"`
+	CAConstraint struct {
+		IsCA           bool `json:"is_ca"`
+		MaxPathLen     int  `json:"max_path_len"`
+		MaxPathLenZero bool `json:"max_path_len_zero"`
+	} `json:"ca_constraint"`
+	AllowedExtensions []string `json:"allowed_extensions"`
+	Policies          []struct {
+		ID         string `json:"id"`
+		Qualifiers []struct {
+			Type  string `json:"type"`
+			Value string `json:"value"`
+		} `json:"qualifiers"`
+	} `json:"policies"`
+	SubjectTemplate string `json:"subject_template"`
+
+	tpl *template.Template // parsed subject template
+	key *csrKey            // key specification required by the template
+}
+
+var (
+	oidCertificatePolicies = asn1.ObjectIdentifier{2, 5, 29, 32}
+	oidQualifierCPS        = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 2, 1}
+	oidQualifierUserNotice = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 2, 2}
+)
+
+var keyUsages = map[string]x509.KeyUsage{
+	"signing":            x509.KeyUsageDigitalSignature,
+	"digital signature":  x509.KeyUsageDigitalSignature,
+	"content commitment": x509.KeyUsageContentCommitment,
+	"key encipherment":   x509.KeyUsageKeyEncipherment,
+	"key agreement":      x509.KeyUsageKeyAgreement,
+	"data encipherment":  x509.KeyUsageDataEncipherment,
+	"cert sign":          x509.KeyUsageCertSign,
+	"crl sign":           x509.KeyUsageCRLSign,
+	"encipher only":      x509.KeyUsageEncipherOnly,
+	"decipher only":      x509.KeyUsageDecipherOnly,
+}
+
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"any":              x509.ExtKeyUsageAny,
+	"server auth":      x509.ExtKeyUsageServerAuth,
+	"client auth":      x509.ExtKeyUsageClientAuth,
+	"code signing":     x509.ExtKeyUsageCodeSigning,
+	"email protection": x509.ExtKeyUsageEmailProtection,
+	"s/mime":           x509.ExtKeyUsageEmailProtection,
+	"ipsec end system": x509.ExtKeyUsageIPSECEndSystem,
+	"ipsec tunnel":     x509.ExtKeyUsageIPSECTunnel,
+	"ipsec user":       x509.ExtKeyUsageIPSECUser,
+	"timestamping":     x509.ExtKeyUsageTimeStamping,
+	"ocsp signing":     x509.ExtKeyUsageOCSPSigning,
+	"microsoft sgc":    x509.ExtKeyUsageMicrosoftServerGatedCrypto,
+	"netscape sgc":     x509.ExtKeyUsageNetscapeServerGatedCrypto,
+}
+
+// Load the CA material, certificates are handled by 'readMaterial' and the
+// key by 'loadCAKey'. The certificate may include, after the signing
+// certificate, the intermediates needed to reach the root. When no key is
+// provided the CA can only be used to verify certificates.
+func loadAuthority(conf *caConfig, rootFile, certFile, keyFile string) (*authority, error) {
+	rootPEM, err := readMaterial(rootFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read root CA certificate: %s", err)
+	}
+	root, err := parseCertificate(rootPEM)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := readMaterial(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate: %s", err)
+	}
+	certs, err := parseCertificates(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	ca := &authority{
+		cert: certs[0],
+		root: root,
+		conf: conf,
+	}
+	if keyFile != "" {
+		if ca.key, err = loadCAKey(keyFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range certs[1:] {
+		if !c.Equal(root) {
+			ca.chain = append(ca.chain, c)
+		}
+	}
+	if !ca.cert.Equal(root) {
+		ca.chain = append([]*x509.Certificate{ca.cert}, ca.chain...)
+	}
+
+	// Validate the CA material
+	if ca.key != nil && !publicKeysMatch(ca.cert.PublicKey, ca.key.Public()) {
+		return nil, errors.New("the private key doesn't match the CA certificate")
+	}
+	if !ca.cert.IsCA {
+		return nil, fmt.Errorf("'%s' is not a CA certificate", ca.cert.Subject.CommonName)
+	}
+	if _, err = ca.cert.Verify(ca.verifyOptions(x509.ExtKeyUsageAny)); err != nil {
+		return nil, fmt.Errorf("the CA certificate is not issued by the root CA: %s", err)
+	}
+	return ca, nil
+}
+
+// Return the signing profile registered with the provided name.
+func (ca *authority) profile(name string) (*signingProfile, error) {
+	if p, ok := ca.conf.Signing.Profiles[name]; ok {
+		return p, nil
+	}
+	if name == "" || name == "default" {
+		if ca.conf.Signing.Default != nil {
+			return ca.conf.Signing.Default, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing profile: %s", name)
+}
+
+// Issue a certificate for the public key in the provided request. The
+// subject and key specification are taken from the JSON request, the
+// remaining settings from the signing profile. Additional extensions must
+// be allowed by the profile. Returns the PEM-encoded certificate.
+func (ca *authority) signCSR(csr *x509.CertificateRequest, req *csrRequest, profileName string, extensions ...pkix.Extension) ([]byte, error) {
+	if err := req.checkKey(csr.PublicKey); err != nil {
+		return nil, err
+	}
+	p, err := ca.profile(profileName)
+	if err != nil {
+		return nil, err
+	}
+	uris, err := req.uris()
+	if err != nil {
+		return nil, err
+	}
+	tpl := &x509.Certificate{
+		Subject:  req.subject(),
+		DNSNames: req.Hosts,
+		URIs:     uris,
+	}
+	if err = p.apply(tpl); err != nil {
+		return nil, err
+	}
+	for _, ext := range extensions {
+		if !p.allowsExtension(ext.Id) {
+			return nil, fmt.Errorf("extension not allowed by the signing profile: %s", ext.Id)
+		}
+		tpl.ExtraExtensions = append(tpl.ExtraExtensions, ext)
+	}
+	if tpl.SerialNumber, err = newSerialNumber(); err != nil {
+		return nil, err
+	}
+	if tpl.SubjectKeyId, err = keyID(csr.PublicKey); err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// Create a self-signed CA certificate for the key using the signing
+// profile. Returns the PEM-encoded certificate.
+func selfSignCA(conf *caConfig, req *csrRequest, key crypto.Signer, profileName string) ([]byte, error) {
+	p, err := (&authority{conf: conf}).profile(profileName)
+	if err != nil {
+		return nil, err
+	}
+	tpl := &x509.Certificate{Subject: req.subject()}
+	if err = p.apply(tpl); err != nil {
+		return nil, err
+	}
+	if !tpl.IsCA {
+		return nil, fmt.Errorf("the '%s' profile is not valid for CA certificates", profileName)
+	}
+	if tpl.SerialNumber, err = newSerialNumber(); err != nil {
+		return nil, err
+	}
+	if tpl.SubjectKeyId, err = keyID(key.Public()); err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// Issue a certificate for the subject and public key of another CA
+// certificate, so it can be validated by users trusting this CA. The
+// validity is limited to the one of the issuing certificate.
+func (ca *authority) crossSign(cert *x509.Certificate, profileName string) ([]byte, error) {
+	p, err := ca.profile(profileName)
+	if err != nil {
+		return nil, err
+	}
+	tpl := &x509.Certificate{
+		Subject:      cert.Subject,
+		SubjectKeyId: cert.SubjectKeyId,
+	}
+	if err = p.apply(tpl); err != nil {
+		return nil, err
+	}
+	if !tpl.IsCA {
+		return nil, fmt.Errorf("the '%s' profile is not valid for CA certificates", profileName)
+	}
+	if tpl.NotAfter.After(ca.cert.NotAfter) {
+		tpl.NotAfter = ca.cert.NotAfter
+	}
+	if tpl.SerialNumber, err = newSerialNumber(); err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca.cert, cert.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// Return the PEM-encoded certificate followed by the CA chain, excluding
+// the root certificate.
+func (ca *authority) bundle(certPEM []byte) []byte {
+	bundle := append([]byte{}, certPEM...)
+	for _, c := range ca.chain {
+		bundle = append(bundle, pemCertificate(c)...)
+	}
+	return bundle
+}
+
+// Verify a PEM-encoded certificate, optionally followed by its chain, was
+// issued by the CA for the usages in the signing profile. Returns the
+// verified certificate.
+func (ca *authority) verifyCertificate(data []byte, profileName string) (*x509.Certificate, error) {
+	p, err := ca.profile(profileName)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseCertificates(data)
+	if err != nil {
+		return nil, err
+	}
+	var usages []x509.ExtKeyUsage
+	for _, u := range append(append([]string{}, p.Usage...), p.Usages...) {
+		if eku, ok := extKeyUsages[u]; ok {
+			usages = append(usages, eku)
+		}
+	}
+	opts := ca.verifyOptions(usages...)
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if _, err = certs[0].Verify(opts); err != nil {
+		return nil, err
+	}
+	return certs[0], nil
+}
+
+func (ca *authority) verifyOptions(usages ...x509.ExtKeyUsage) x509.VerifyOptions {
+	opts := x509.VerifyOptions{
+		Roots:         ca.roots(),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     usages,
+	}
+	for _, c := range ca.chain {
+		opts.Intermediates.AddCert(c)
+	}
+	return opts
+}
+
+// Return the pool of trust anchors: the root CA and the trust bundle.
+func (ca *authority) roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.root)
+	for _, c := range ca.trusted {
+		pool.AddCert(c)
+	}
+	return pool
+}
+
+// Add the CA certificates in the trust bundle as trust anchors. Bundles
+// are used to keep accepting certificates issued by a previous root during
+// a rotation, or issued by partner organizations.
+func (ca *authority) loadTrustBundle(location string) error {
+	bundle, err := readMaterial(location)
+	if err != nil {
+		return fmt.Errorf("failed to read trust bundle: %s", err)
+	}
+	certs, err := parseCertificates(bundle)
+	if err != nil {
+		return err
+	}
+	for _, c := range certs {
+		if !c.IsCA {
+			return fmt.Errorf("'%s' in the trust bundle is not a CA certificate", c.Subject.CommonName)
+		}
+		if !c.Equal(ca.root) {
+			ca.trusted = append(ca.trusted, c)
+		}
+	}
+	return nil
+}
+
+// Load the profile settings into a certificate template.
+func (p *signingProfile) apply(tpl *x509.Certificate) error {
+	// Validity window, backdated to tolerate clock skew
+	expiry, err := time.ParseDuration(p.Expiry)
+	if err != nil {
+		return fmt.Errorf("invalid profile expiry: %s", p.Expiry)
+	}
+	tpl.NotBefore = time.Now().Add(-5 * time.Minute).UTC()
+	tpl.NotAfter = tpl.NotBefore.Add(expiry)
+
+	// Key usages
+	usages := append([]string{}, p.Usage...)
+	for _, u := range append(usages, p.Usages...) {
+		if ku, ok := keyUsages[u]; ok {
+			tpl.KeyUsage |= ku
+			continue
+		}
+		if eku, ok := extKeyUsages[u]; ok {
+			tpl.ExtKeyUsage = append(tpl.ExtKeyUsage, eku)
+			continue
+		}
+		return fmt.Errorf("unknown key usage: %s", u)
+	}
+
+	// Constraints and distribution points
+	tpl.BasicConstraintsValid = true
+	if p.CAConstraint.IsCA {
+		tpl.IsCA = true
+		tpl.MaxPathLen = p.CAConstraint.MaxPathLen
+		tpl.MaxPathLenZero = p.CAConstraint.MaxPathLenZero
+	}
+	tpl.IssuingCertificateURL = p.IssuerURLs
+	if p.CRL != "" {
+		tpl.CRLDistributionPoints = []string{p.CRL}
+	}
+	if p.OCSP != "" {
+		tpl.OCSPServer = []string{p.OCSP}
+	}
+
+	// Certificate policies
+	if len(p.Policies) > 0 {
+		ext, err := p.policiesExtension()
+		if err != nil {
+			return err
+		}
+		tpl.ExtraExtensions = append(tpl.ExtraExtensions, ext)
+	}
+	return nil
+}
+
+// Check if the profile allows including the extension in certificates.
+func (p *signingProfile) allowsExtension(id asn1.ObjectIdentifier) bool {
+	for _, el := range p.AllowedExtensions {
+		if el == id.String() {
+			return true
+		}
+	}
+	return false
+}
+
+type policyInformation struct {
+	ID         asn1.ObjectIdentifier
+	Qualifiers []policyQualifier `asn1:"omitempty"`
+}
+
+type policyQualifier struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type userNotice struct {
+	ExplicitText string `asn1:"utf8"`
+}
+
+// Build the certificate policies extension, including the CPS and user
+// notice qualifiers that are not supported by the standard library.
+func (p *signingProfile) policiesExtension() (pkix.Extension, error) {
+	ext := pkix.Extension{Id: oidCertificatePolicies}
+	var policies []policyInformation
+	for _, pol := range p.Policies {
+		id, err := parseOID(pol.ID)
+		if err != nil {
+			return ext, err
+		}
+		pi := policyInformation{ID: id}
+		for _, q := range pol.Qualifiers {
+			switch q.Type {
+			case "id-qt-cps":
+				pi.Qualifiers = append(pi.Qualifiers, policyQualifier{
+					ID:    oidQualifierCPS,
+					Value: asn1.RawValue{Tag: asn1.TagIA5String, Bytes: []byte(q.Value)},
+				})
+			case "id-qt-unotice":
+				notice, err := asn1.Marshal(userNotice{ExplicitText: q.Value})
+				if err != nil {
+					return ext, err
+				}
+				pi.Qualifiers = append(pi.Qualifiers, policyQualifier{
+					ID:    oidQualifierUserNotice,
+					Value: asn1.RawValue{FullBytes: notice},
+				})
+			default:
+				return ext, fmt.Errorf("unsupported policy qualifier: %s", q.Type)
+			}
+		}
+		policies = append(policies, pi)
+	}
+	val, err := asn1.Marshal(policies)
+	if err != nil {
+		return ext, err
+	}
+	ext.Value = val
+	return ext, nil
+}
+
+// Parse an OID in dotted notation.
+func parseOID(value string) (asn1.ObjectIdentifier, error) {
+	var oid asn1.ObjectIdentifier
+	for _, seg := range strings.Split(value, ".") {
+		n, err := strconv.Atoi(seg)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID: %s", value)
+		}
+		oid = append(oid, n)
+	}
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("invalid OID: %s", value)
+	}
+	return oid, nil
+}
+
+// Random 159-bit certificate serial number.
+func newSerialNumber() (*big.Int, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	b[0] &= 0x7f
+	return new(big.Int).SetBytes(b), nil
+}
+
+// Subject key identifier, as described in RFC 5280 section 4.2.1.2 (1).
+func keyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	bits, err := publicKeyBits(der)
+	if err != nil {
+		return nil, err
+	}
+	id := sha1.Sum(bits)
+	return id[:], nil
+}
+
+// Return the public key bits from a DER-encoded 'SubjectPublicKeyInfo'.
+func publicKeyBits(spkiDER []byte) ([]byte, error) {
+	spki := struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{}
+	if _, err := asn1.Unmarshal(spkiDER, &spki); err != nil {
+		return nil, err
+	}
+	return spki.PublicKey.Bytes, nil
+}
+
+// PEM-encode a certificate.
+func pemCertificate(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+// Decode a PEM-encoded certificate.
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("invalid PEM certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Decode all the PEM-encoded certificates in the provided data.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var list []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, cert)
+	}
+	if len(list) == 0 {
+		return nil, errors.New("no PEM certificates found")
+	}
+	return list, nil
+}
+
+// Check both public keys are the same.
+func publicKeysMatch(a, b crypto.PublicKey) bool {
+	ad, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	bd, err := x509.MarshalPKIXPublicKey(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ad, bd)
+}
+
+func decodeCAConfig(data []byte) (*caConfig, error) {
+	conf := &caConfig{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bryk-io/x/cli"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var certsCmd = &cobra.Command{
+	Use:   "certs",
+	Short: "Inspect the registry of issued certificates",
+}
+
+var certsListCmd = &cobra.Command{
+	Use:     "list",
+	Short:   "List issued certificates",
+	Example: "suss-workshop certs list --status valid",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		reg, err := openRegistry(viper.GetString("ca.registry"))
+		if err != nil {
+			return err
+		}
+		list, err := reg.list(statusFilter(viper.GetString("certs.list.status")))
+		if err != nil {
+			return err
+		}
+		printRecords(list)
+		return nil
+	},
+}
+
+var certsSearchCmd = &cobra.Command{
+	Use:     "search",
+	Short:   "Search issued certificates by DID or serial number",
+	Example: "suss-workshop certs search did:bryk:4d81bd52",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("you need to provide a search term")
+		}
+		reg, err := openRegistry(viper.GetString("ca.registry"))
+		if err != nil {
+			return err
+		}
+		list, err := reg.search(args[0])
+		if err != nil {
+			return err
+		}
+		filter := statusFilter(viper.GetString("certs.search.status"))
+		var res []*certRecord
+		for _, rec := range list {
+			if filter == nil || filter(rec) {
+				res = append(res, rec)
+			}
+		}
+		printRecords(res)
+		return nil
+	},
+}
+
+var certsShowCmd = &cobra.Command{
+	Use:     "show",
+	Short:   "Show the details of an issued certificate",
+	Example: "suss-workshop certs show 4d81bd522edb4703",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("you need to provide the certificate serial number")
+		}
+		serial, err := parseSerial(args[0])
+		if err != nil {
+			return err
+		}
+		reg, err := openRegistry(viper.GetString("ca.registry"))
+		if err != nil {
+			return err
+		}
+		rec, err := reg.get(formatSerial(serial))
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			return errors.New("certificate not found")
+		}
+		fmt.Printf("serial:     %s\n", rec.Serial)
+		fmt.Printf("did:        %s\n", rec.DID)
+		fmt.Printf("profile:    %s\n", rec.Profile)
+		fmt.Printf("source:     %s\n", rec.Source)
+		fmt.Printf("issued at:  %s\n", rec.IssuedAt.Local().Format(time.RFC822))
+		fmt.Printf("not before: %s\n", rec.NotBefore.Local().Format(time.RFC822))
+		fmt.Printf("not after:  %s\n", rec.NotAfter.Local().Format(time.RFC822))
+		fmt.Printf("status:     %s\n", rec.status())
+		if rec.Revoked {
+			fmt.Printf("revoked at: %s\n", rec.RevokedAt.Local().Format(time.RFC822))
+			fmt.Printf("reason:     %s\n", reasonName(rec.Reason))
+		}
+		fmt.Printf("\n%s", rec.Cert)
+		return nil
+	},
+}
+
+func init() {
+	listParams := []cli.Param{
+		{
+			Name:      "status",
+			Usage:     "only include certificates with the given status (valid, expired or revoked)",
+			FlagKey:   "certs.list.status",
+			ByDefault: "",
+		},
+	}
+	if err := cli.SetupCommandParams(certsListCmd, listParams); err != nil {
+		panic(err)
+	}
+	searchParams := []cli.Param{
+		{
+			Name:      "status",
+			Usage:     "only include certificates with the given status (valid, expired or revoked)",
+			FlagKey:   "certs.search.status",
+			ByDefault: "",
+		},
+	}
+	if err := cli.SetupCommandParams(certsSearchCmd, searchParams); err != nil {
+		panic(err)
+	}
+	certsCmd.AddCommand(certsListCmd, certsSearchCmd, certsShowCmd)
+	rootCmd.AddCommand(certsCmd)
+}
+
+func statusFilter(status string) func(*certRecord) bool {
+	if status == "" {
+		return nil
+	}
+	return func(rec *certRecord) bool {
+		return rec.status() == status
+	}
+}
+
+func printRecords(list []*certRecord) {
+	if len(list) == 0 {
+		fmt.Println("no certificates found")
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERIAL\tDID\tPROFILE\tSOURCE\tNOT AFTER\tSTATUS")
+	for _, rec := range list {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			rec.Serial,
+			rec.DID,
+			rec.Profile,
+			rec.Source,
+			rec.NotAfter.Local().Format(time.RFC822),
+			rec.status())
+	}
+	tw.Flush()
+}
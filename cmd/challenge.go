@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Challenge issued by the server to authorize an enrollment request.
+type challenge struct {
+	Value   string    `json:"challenge"`
+	DID     string    `json:"did"`
+	Expires time.Time `json:"expires"`
+	Key     *csrKey   `json:"key,omitempty"` // key required for the CSR
+	used    bool
+}
+
+// Maximum number of outstanding challenges for a single DID, issuing a
+// new one replaces the oldest.
+const maxChallengesPerDID = 3
+
+// Returned when the store holds the maximum number of challenges allowed.
+var errTooManyChallenges = errors.New("too many outstanding challenges, try again later")
+
+// Server-side store for enrollment challenges. Every challenge is bound
+// to the DID it was requested for, expires after a given TTL and can only
+// be redeemed once. Challenges are issued to unauthenticated users, so the
+// number of outstanding entries is bounded both per DID and globally.
+type challengeStore struct {
+	ttl     time.Duration
+	limit   int
+	entries map[string]*challenge
+	byDID   map[string][]string // challenge values, in issuance order
+	mu      sync.Mutex
+}
+
+func newChallengeStore(ttl time.Duration, limit int) *challengeStore {
+	return &challengeStore{
+		ttl:     ttl,
+		limit:   limit,
+		entries: make(map[string]*challenge),
+		byDID:   make(map[string][]string),
+	}
+}
+
+// Generate a new random challenge for the provided DID.
+func (cs *challengeStore) issue(id string) (*challenge, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	c := &challenge{
+		Value:   hex.EncodeToString(nonce),
+		DID:     id,
+		Expires: time.Now().Add(cs.ttl),
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if list := cs.byDID[id]; len(list) >= maxChallengesPerDID {
+		cs.remove(list[0])
+	} else if len(cs.entries) >= cs.limit {
+		return nil, errTooManyChallenges
+	}
+	cs.entries[c.Value] = c
+	cs.byDID[id] = append(cs.byDID[id], c.Value)
+	return c, nil
+}
+
+// Mark a challenge as used. Fails if the challenge was never issued by
+// the store, was issued for a different DID, is expired or was already
+// redeemed.
+func (cs *challengeStore) redeem(id, value string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.entries[value]
+	if !ok {
+		return errors.New("unknown challenge")
+	}
+	if c.used {
+		return errors.New("challenge already used")
+	}
+	if time.Now().After(c.Expires) {
+		cs.remove(value)
+		return errors.New("challenge expired")
+	}
+	if c.DID != id {
+		return errors.New("challenge was not issued for the provided DID")
+	}
+	c.used = true
+	return nil
+}
+
+// Periodically remove expired entries from the store. Used challenges
+// are kept until they expire to properly report replay attempts.
+func (cs *challengeStore) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		cs.mu.Lock()
+		for k, c := range cs.entries {
+			if now.After(c.Expires) {
+				cs.remove(k)
+			}
+		}
+		cs.mu.Unlock()
+	}
+}
+
+// Delete a challenge from the store, must be called with the lock held.
+func (cs *challengeStore) remove(value string) {
+	c, ok := cs.entries[value]
+	if !ok {
+		return
+	}
+	delete(cs.entries, value)
+	list := cs.byDID[c.DID]
+	for i, v := range list {
+		if v == value {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(cs.byDID, c.DID)
+		return
+	}
+	cs.byDID[c.DID] = list
+}
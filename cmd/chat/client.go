@@ -1,8 +1,8 @@
 package chat
 
 import (
-	"bytes"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -19,12 +19,7 @@ const (
 	pingPeriod = (pongWait * 9) / 10
 
 	// Maximum message size allowed from peer.
-	maxMessageSize = 512
-)
-
-var (
-	newline = []byte{'\n'}
-	space   = []byte{' '}
+	maxMessageSize = 2048
 )
 
 // Client is a middleman between the websocket connection and the Hub.
@@ -35,7 +30,10 @@ type Client struct {
 	Conn *websocket.Conn
 
 	// Buffered channel of outbound messages.
-	Send chan []byte
+	Send chan *Message
+
+	// Identity the client authenticated as.
+	Identity Identity
 }
 
 // Read pumps messages from the websocket connection to the Hub.
@@ -52,18 +50,57 @@ func (c *Client) Read() {
 	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.Conn.SetPongHandler(func(string) error { c.Conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
-		_, message, err := c.Conn.ReadMessage()
+		_, frame, err := c.Conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("error: %v", err)
 			}
 			break
 		}
-		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-		c.Hub.broadcast <- message
+		message, err := c.decode(frame)
+		if err != nil {
+			log.Printf("invalid message from %s: %s", c.Identity.DID, err)
+			continue
+		}
+		d := &delivery{client: c, message: message}
+		if message.Type == TypeDirect && c.Hub.Directory != nil && strings.HasPrefix(message.To, "did:") {
+			d.known = c.Hub.Directory(message.To)
+		}
+		c.Hub.inbound <- d
 	}
 }
 
+// Decode a frame received from the peer, using the legacy text format
+// unless the JSON protocol was negotiated. The sender and timestamp are
+// always set by the server, based on the identity of the client.
+func (c *Client) decode(frame []byte) (*Message, error) {
+	var (
+		message *Message
+		err     error
+	)
+	if c.legacy() {
+		_, message = ParseLegacy(string(frame))
+		err = message.validate()
+	} else {
+		message, err = DecodeMessage(frame)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if message.ID == "" {
+		message.ID = newID()
+	}
+	sender := c.Identity
+	message.Sender = &sender
+	message.Timestamp = time.Now().UTC()
+	return message, nil
+}
+
+// Check if the peer uses the legacy text format.
+func (c *Client) legacy() bool {
+	return c.Conn.Subprotocol() != Protocol
+}
+
 // Write pumps messages from the Hub to the websocket connection.
 //
 // A goroutine running Write is started for each connection. The
@@ -85,20 +122,12 @@ func (c *Client) Write() {
 				return
 			}
 
-			w, err := c.Conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			// Add queued chat messages to the current websocket message.
-			n := len(c.Send)
-			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write(<-c.Send)
+			// Each message is sent on its own frame
+			frame := message.Encode()
+			if c.legacy() {
+				frame = []byte(message.Legacy())
 			}
-
-			if err := w.Close(); err != nil {
+			if err := c.Conn.WriteMessage(websocket.TextMessage, frame); err != nil {
 				return
 			}
 		case <-ticker.C:
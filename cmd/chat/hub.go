@@ -1,28 +1,96 @@
 package chat
 
-// Hub maintains the set of active clients and broadcasts messages to the
-// clients.
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Hub maintains the set of active clients and the rooms they joined,
+// delivering messages to the members of each room.
 type Hub struct {
 	// Register requests from the clients.
 	Register chan *Client
 
+	// Directory reports if a DID belongs to a registered user, it's used to
+	// tell unknown recipients of direct messages from offline ones. Optional,
+	// must be set before running the hub. Lookups are done by the clients
+	// before queuing each message, never on the hub's event loop.
+	Directory func(did string) bool
+
 	// Registered clients.
 	clients map[*Client]bool
 
+	// Registered clients, by DID. Users may be connected more than once.
+	sessions map[string]map[*Client]bool
+
 	// Inbound messages from the clients.
-	broadcast chan []byte
+	inbound chan *delivery
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Available rooms, by name.
+	rooms map[string]*room
+
+	// Room clients join when registered, the first predefined room.
+	lobby string
+
+	// Allow clients to create rooms on demand.
+	allowCreate bool
+}
+
+// Message received from a client. For direct messages 'known' reports
+// if the recipient is a registered user.
+type delivery struct {
+	client  *Client
+	message *Message
+	known   bool
+}
+
+// Room members, predefined rooms are kept even when empty.
+type room struct {
+	name       string
+	members    map[*Client]bool
+	predefined bool
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		broadcast:  make(chan []byte),
-		Register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
+// RoomInfo describes a room in 'list' responses.
+type RoomInfo struct {
+	Name    string      `json:"name"`
+	Size    int         `json:"size"`
+	Joined  bool        `json:"joined"`
+	Members []*Identity `json:"members,omitempty"`
+}
+
+// NewHub returns a hub with the provided predefined rooms, clients join the
+// first one when registered. When 'allowCreate' is set joining a room that
+// doesn't exist creates it; rooms created this way are removed once empty.
+func NewHub(rooms []string, allowCreate bool) (*Hub, error) {
+	h := &Hub{
+		inbound:     make(chan *delivery),
+		Register:    make(chan *Client),
+		unregister:  make(chan *Client),
+		clients:     make(map[*Client]bool),
+		sessions:    make(map[string]map[*Client]bool),
+		rooms:       make(map[string]*room),
+		allowCreate: allowCreate,
+	}
+	for _, name := range rooms {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !roomName.MatchString(name) {
+			return nil, fmt.Errorf("invalid room name: %s", name)
+		}
+		h.rooms[name] = &room{name: name, members: make(map[*Client]bool), predefined: true}
+		if h.lobby == "" {
+			h.lobby = name
+		}
 	}
+	if h.lobby == "" {
+		return nil, errors.New("at least one room is required")
+	}
+	return h, nil
 }
 
 func (h *Hub) Run() {
@@ -30,20 +98,240 @@ func (h *Hub) Run() {
 		select {
 		case client := <-h.Register:
 			h.clients[client] = true
+			if h.sessions[client.Identity.DID] == nil {
+				h.sessions[client.Identity.DID] = make(map[*Client]bool)
+			}
+			h.sessions[client.Identity.DID][client] = true
+			h.join(client, h.lobby)
 		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.Send)
+			h.drop(client)
+		case d := <-h.inbound:
+			if h.clients[d.client] {
+				h.handle(d)
+			}
+		}
+	}
+}
+
+// Process a message received from a client.
+func (h *Hub) handle(d *delivery) {
+	c, m := d.client, d.message
+	m.Room = strings.ToLower(m.Room)
+	switch m.Type {
+	case TypeMessage:
+		if m.Room == "" {
+			m.Room = h.lobby
+		}
+		r, ok := h.rooms[m.Room]
+		if !ok || !r.members[c] {
+			h.reply(c, m.Room, "you are not a member of the room")
+			return
+		}
+		h.broadcast(r, m)
+	case TypeJoin:
+		h.join(c, m.Room)
+	case TypeLeave:
+		// Leaving without a room means the client is going away
+		if m.Room == "" {
+			for _, r := range h.joined(c) {
+				h.leave(c, r)
+			}
+			return
+		}
+		r, ok := h.rooms[m.Room]
+		if !ok || !r.members[c] {
+			h.reply(c, m.Room, "you are not a member of the room")
+			return
+		}
+		h.leave(c, r)
+		h.send(c, h.notice(c, TypeLeave, r.name))
+	case TypeList:
+		h.list(c, m.Room)
+	case TypeDirect:
+		h.direct(c, m, d.known)
+	}
+}
+
+// Deliver a direct message to every connection of the recipient, and of
+// the sender so the message is displayed on all its sessions. Recipients
+// are provided by DID or, if unambiguous, by display name. Bodies are
+// encrypted by the clients and forwarded as-is.
+func (h *Hub) direct(c *Client, m *Message, known bool) {
+	m.Room = ""
+	to, err := h.recipient(m.To, known)
+	if err != nil {
+		h.reply(c, "", err.Error())
+		return
+	}
+	m.To = to
+	for member := range h.sessions[to] {
+		h.send(member, m)
+	}
+	if to == c.Identity.DID {
+		return
+	}
+	for member := range h.sessions[c.Identity.DID] {
+		h.send(member, m)
+	}
+}
+
+// Return the DID of a connected user.
+func (h *Hub) recipient(to string, known bool) (string, error) {
+	if strings.HasPrefix(to, "did:") {
+		if len(h.sessions[to]) > 0 {
+			return to, nil
+		}
+		if h.Directory != nil && !known {
+			return "", fmt.Errorf("unknown recipient: %s", to)
+		}
+		return "", fmt.Errorf("recipient is offline: %s", to)
+	}
+	did := ""
+	for id, clients := range h.sessions {
+		for member := range clients {
+			if member.Identity.Name != to {
+				continue
 			}
-		case message := <-h.broadcast:
-			for client := range h.clients {
-				select {
-				case client.Send <- message:
-				default:
-					close(client.Send)
-					delete(h.clients, client)
-				}
+			if did != "" && did != id {
+				return "", fmt.Errorf("more than one user is named '%s', use the DID instead", to)
 			}
+			did = id
 		}
 	}
+	if did == "" {
+		return "", fmt.Errorf("recipient is offline or unknown: %s", to)
+	}
+	return did, nil
+}
+
+// Add the client to the room, creating it if allowed.
+func (h *Hub) join(c *Client, name string) {
+	if name == "" {
+		name = h.lobby
+	}
+	r, ok := h.rooms[name]
+	if !ok {
+		if !h.allowCreate {
+			h.reply(c, name, "unknown room")
+			return
+		}
+		r = &room{name: name, members: make(map[*Client]bool)}
+		h.rooms[name] = r
+	}
+	if r.members[c] {
+		return
+	}
+	r.members[c] = true
+	h.broadcast(r, h.notice(c, TypeJoin, name))
+}
+
+// Remove the client from the room, notifying the remaining members.
+func (h *Hub) leave(c *Client, r *room) {
+	delete(r.members, c)
+	if len(r.members) == 0 && !r.predefined {
+		delete(h.rooms, r.name)
+		return
+	}
+	h.broadcast(r, h.notice(c, TypeLeave, r.name))
+}
+
+// Reply with the available rooms or, when a room is provided, with its
+// members.
+func (h *Hub) list(c *Client, name string) {
+	res := NewMessage(TypeList, "")
+	if name != "" {
+		r, ok := h.rooms[name]
+		if !ok {
+			h.reply(c, name, "unknown room")
+			return
+		}
+		info := h.info(c, r)
+		for member := range r.members {
+			id := member.Identity
+			info.Members = append(info.Members, &id)
+		}
+		sort.Slice(info.Members, func(i, j int) bool {
+			return info.Members[i].Label() < info.Members[j].Label()
+		})
+		res.Rooms = append(res.Rooms, info)
+	} else {
+		for _, r := range h.rooms {
+			res.Rooms = append(res.Rooms, h.info(c, r))
+		}
+		sort.Slice(res.Rooms, func(i, j int) bool {
+			return res.Rooms[i].Name < res.Rooms[j].Name
+		})
+	}
+	h.send(c, res)
+}
+
+// Summary of the room, from the point of view of the client.
+func (h *Hub) info(c *Client, r *room) *RoomInfo {
+	return &RoomInfo{
+		Name:   r.name,
+		Size:   len(r.members),
+		Joined: r.members[c],
+	}
+}
+
+// Rooms the client is a member of.
+func (h *Hub) joined(c *Client) []*room {
+	var list []*room
+	for _, r := range h.rooms {
+		if r.members[c] {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+// Membership notification for the client.
+func (h *Hub) notice(c *Client, kind, room string) *Message {
+	m := NewMessage(kind, "")
+	sender := c.Identity
+	m.Sender = &sender
+	m.Room = room
+	return m
+}
+
+// Send an error message to the client.
+func (h *Hub) reply(c *Client, room, reason string) {
+	m := NewMessage(TypeError, reason)
+	m.Room = room
+	h.send(c, m)
+}
+
+// Deliver the message to every member of the room.
+func (h *Hub) broadcast(r *room, m *Message) {
+	for member := range r.members {
+		h.send(member, m)
+	}
+}
+
+// Queue a message for the client, clients not keeping up are dropped.
+func (h *Hub) send(c *Client, m *Message) {
+	if !h.clients[c] {
+		return
+	}
+	select {
+	case c.Send <- m:
+	default:
+		h.drop(c)
+	}
+}
+
+// Remove the client from the hub and all its rooms.
+func (h *Hub) drop(c *Client) {
+	if !h.clients[c] {
+		return
+	}
+	delete(h.clients, c)
+	delete(h.sessions[c.Identity.DID], c)
+	if len(h.sessions[c.Identity.DID]) == 0 {
+		delete(h.sessions, c.Identity.DID)
+	}
+	close(c.Send)
+	for _, r := range h.joined(c) {
+		h.leave(c, r)
+	}
 }
@@ -0,0 +1,177 @@
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Protocol is the websocket subprotocol used to exchange JSON messages.
+// Clients that don't negotiate it use the legacy 'alias: text' format.
+const Protocol = "suss.v1"
+
+// Version of the message envelope.
+const Version = 1
+
+// Encryption scheme for direct messages, NaCl box with X25519 key
+// agreement keys published in the DID documents of the participants.
+const EncryptionBox = "x25519-xsalsa20-poly1305"
+
+// Message types.
+const (
+	TypeMessage = "message"
+	TypeJoin    = "join"
+	TypeLeave   = "leave"
+	TypeList    = "list"
+	TypeDirect  = "direct"
+	TypeError   = "error"
+)
+
+// MaxBodySize is the maximum length of a message body.
+const MaxBodySize = 1024
+
+// Limits for the values provided by clients.
+const (
+	maxIDSize        = 64
+	maxRecipientSize = 256
+)
+
+// Valid room names.
+var roomName = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// Identity of a connected user, as asserted by the server based on the
+// certificate used to authenticate.
+type Identity struct {
+	DID  string `json:"did"`
+	Name string `json:"name,omitempty"`
+}
+
+// Label returns the name to display for the user, the DID if no display
+// name is available.
+func (id *Identity) Label() string {
+	if id.Name != "" {
+		return id.Name
+	}
+	return id.DID
+}
+
+// Message is the envelope for every frame exchanged with JSON clients.
+// The sender and timestamp are always set by the server, any value
+// provided by the client is ignored.
+type Message struct {
+	Version   int         `json:"v"`
+	Type      string      `json:"type"`
+	ID        string      `json:"id"`
+	Sender    *Identity   `json:"sender,omitempty"`
+	Timestamp time.Time   `json:"ts"`
+	Room      string      `json:"room,omitempty"`
+	To        string      `json:"to,omitempty"`
+	Enc       string      `json:"enc,omitempty"`
+	Body      string      `json:"body,omitempty"`
+	Rooms     []*RoomInfo `json:"rooms,omitempty"`
+}
+
+// NewMessage returns a message of the provided type with a random ID.
+func NewMessage(kind, body string) *Message {
+	return &Message{
+		Version:   Version,
+		Type:      kind,
+		ID:        newID(),
+		Timestamp: time.Now().UTC(),
+		Body:      body,
+	}
+}
+
+// DecodeMessage parses a JSON frame received from a client.
+func DecodeMessage(data []byte) (*Message, error) {
+	m := &Message{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, errors.New("invalid message")
+	}
+	if m.Version != Version {
+		return nil, fmt.Errorf("unsupported message version: %d", m.Version)
+	}
+	return m, m.validate()
+}
+
+// ParseLegacy parses a frame in the legacy 'alias: text' format. Only the
+// first ':' is used as separator, frames without one are treated as text.
+// The alias is claimed by the sender so it's returned separately, it must
+// not be used as the message sender.
+func ParseLegacy(text string) (string, *Message) {
+	m := NewMessage(TypeMessage, "")
+	segs := strings.SplitN(text, ":", 2)
+	if len(segs) == 1 {
+		m.Body = strings.TrimSpace(segs[0])
+		return "", m
+	}
+	m.Body = strings.TrimSpace(segs[1])
+	return strings.TrimSpace(segs[0]), m
+}
+
+// Legacy returns the message in the 'alias: text' format, using the
+// label of the sender as alias.
+func (m *Message) Legacy() string {
+	sender := ""
+	if m.Sender != nil {
+		sender = m.Sender.Label()
+	}
+	switch m.Type {
+	case TypeJoin:
+		return fmt.Sprintf("%s: joined the room", sender)
+	case TypeLeave:
+		return fmt.Sprintf("%s: is going away", sender)
+	case TypeDirect:
+		return fmt.Sprintf("%s: sent you an encrypted direct message", sender)
+	case TypeError:
+		return fmt.Sprintf("error: %s", m.Body)
+	default:
+		return fmt.Sprintf("%s: %s", sender, m.Body)
+	}
+}
+
+// Encode returns the JSON encoding of the message.
+func (m *Message) Encode() []byte {
+	js, _ := json.Marshal(m)
+	return js
+}
+
+// Verify the values provided by a client.
+func (m *Message) validate() error {
+	switch m.Type {
+	case TypeMessage, TypeJoin, TypeLeave, TypeList:
+	case TypeDirect:
+		if m.To == "" {
+			return errors.New("direct messages require a recipient")
+		}
+		if m.Enc != EncryptionBox {
+			return errors.New("direct messages must be end-to-end encrypted")
+		}
+	default:
+		return fmt.Errorf("unsupported message type: %s", m.Type)
+	}
+	if len(m.To) > maxRecipientSize {
+		return errors.New("message recipient is too long")
+	}
+	if m.Room != "" && !roomName.MatchString(strings.ToLower(m.Room)) {
+		return errors.New("invalid room name")
+	}
+	if len(m.ID) > maxIDSize {
+		return errors.New("message ID is too long")
+	}
+	if len(m.Body) > MaxBodySize {
+		return errors.New("message body is too long")
+	}
+	return nil
+}
+
+func newID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
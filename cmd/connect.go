@@ -1,16 +1,24 @@
 package cmd
 
 import (
+	"bufio"
+	"crypto"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/aidtechnology/suss-workshop/cmd/chat"
 	"github.com/bryk-io/x/cli"
 	"github.com/chzyer/readline"
 	"github.com/gorilla/websocket"
@@ -26,10 +34,20 @@ var connectCmd = &cobra.Command{
 }
 
 type session struct {
-	alias   string
-	ws      *websocket.Conn
-	rl      *readline.Instance
-	errChan chan error
+	alias     string
+	did       string
+	room      string
+	ws        *websocket.Conn
+	rl        *readline.Instance
+	errChan   chan error
+	resolver  Resolver
+	agreement *[32]byte
+
+	// DIDs of the users seen during the session, by display name, and
+	// the key agreement methods resolved for them
+	peers map[string]string
+	keys  map[string][]*agreementKey
+	mu    sync.Mutex
 }
 
 func (s *session) readConsole() {
@@ -41,20 +59,97 @@ func (s *session) readConsole() {
 		}
 
 		if line == "bye" || line == "close" || line == "exit" {
-			msg := fmt.Sprintf("%s: %s", aurora.Red(s.alias), "is going away")
-			s.ws.WriteMessage(websocket.TextMessage, []byte(msg))
+			s.send(chat.NewMessage(chat.TypeLeave, ""))
 			s.errChan <- nil
 			return
 		}
 
-		line = fmt.Sprintf("%s: %s", s.alias, line)
-		if err = s.ws.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+		if strings.HasPrefix(line, "/") {
+			if err = s.command(line); err != nil {
+				fmt.Fprintf(s.rl.Stdout(), "%s\n", aurora.Red(err))
+			}
+			continue
+		}
+
+		msg := chat.NewMessage(chat.TypeMessage, line)
+		msg.Room = s.room
+		if err = s.send(msg); err != nil {
 			s.errChan <- err
 			return
 		}
 	}
 }
 
+// Process a console command, the following commands are supported:
+//
+//	/join <room>    join a room and make it the active one
+//	/leave [room]   leave a room, by default the active one
+//	/room [room]    switch the active room, or show it when none is provided
+//	/rooms          list the available rooms
+//	/who [room]     list the members of a room, by default the active one
+//	/msg <to> text  send an encrypted direct message to a user, by DID or display name
+func (s *session) command(line string) error {
+	if s.legacy() {
+		return errors.New("commands are not supported by the service")
+	}
+	args := strings.Fields(line)
+	arg := ""
+	if len(args) > 1 {
+		arg = strings.ToLower(args[1])
+	}
+	var msg *chat.Message
+	switch args[0] {
+	case "/join":
+		if arg == "" {
+			return errors.New("you need to provide the room to join")
+		}
+		msg = chat.NewMessage(chat.TypeJoin, "")
+		msg.Room = arg
+		s.room = arg
+	case "/leave":
+		if arg == "" {
+			arg = s.room
+		}
+		if arg == "" {
+			return errors.New("you need to provide the room to leave")
+		}
+		msg = chat.NewMessage(chat.TypeLeave, "")
+		msg.Room = arg
+		if arg == s.room {
+			s.room = ""
+		}
+	case "/room":
+		if arg == "" {
+			fmt.Fprintf(s.rl.Stdout(), "active room: %s\n", s.roomLabel(s.room))
+			return nil
+		}
+		s.room = arg
+		return nil
+	case "/rooms":
+		msg = chat.NewMessage(chat.TypeList, "")
+	case "/who":
+		msg = chat.NewMessage(chat.TypeList, "")
+		msg.Room = arg
+		if arg == "" {
+			msg.Room = s.room
+		}
+		if msg.Room == "" {
+			return errors.New("you need to provide the room")
+		}
+	case "/msg":
+		if len(args) < 3 {
+			return errors.New("usage: /msg <did|alias> text")
+		}
+		var err error
+		if msg, err = s.direct(args[1], strings.Join(args[2:], " ")); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+	return s.send(msg)
+}
+
 func (s *session) readWebsocket() {
 	for {
 		msgType, buf, err := s.ws.ReadMessage()
@@ -62,21 +157,221 @@ func (s *session) readWebsocket() {
 			s.errChan <- err
 			return
 		}
-		var text string
-		switch msgType {
-		case websocket.TextMessage:
-			text = string(buf)
-		default:
+		if msgType != websocket.TextMessage {
 			s.errChan <- fmt.Errorf("unknown websocket frame type: %d", msgType)
 			return
 		}
-		segs := strings.Split(text, ":")
-		if segs[0] == s.alias {
-			fmt.Fprint(s.rl.Stdout(), fmt.Sprintf("%s: %s\n", aurora.Yellow(segs[0]), segs[1]))
-		} else {
-			fmt.Fprint(s.rl.Stdout(), fmt.Sprintf("%s: %s\n", aurora.Blue(segs[0]), segs[1]))
+		// Senders are only verified when using the JSON protocol, legacy
+		// services relay the alias claimed by each user
+		var (
+			msg   = &chat.Message{}
+			alias string
+		)
+		if s.legacy() {
+			alias, msg = chat.ParseLegacy(string(buf))
+		} else if err = json.Unmarshal(buf, msg); err != nil {
+			continue
 		}
+		s.learn(msg)
+		if msg.Type == chat.TypeDirect {
+			if err = s.decrypt(msg); err != nil {
+				fmt.Fprintf(s.rl.Stdout(), "%s\n", aurora.Red(fmt.Sprintf("failed to decrypt direct message: %s", err)))
+				continue
+			}
+		}
+		s.print(msg, alias)
+	}
+}
+
+// Encrypt a direct message for the recipient, provided by DID or by the
+// display name of a user seen during the session.
+func (s *session) direct(to, body string) (*chat.Message, error) {
+	if s.agreement == nil {
+		return nil, errors.New("an agreement key is required to send direct messages, see '--agreement-key'")
+	}
+	recipient, err := s.peer(to)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := s.agreementKeys(recipient)
+	if err != nil {
+		return nil, err
 	}
+	sealed, err := sealDirect(body, keys, s.agreement)
+	if err != nil {
+		return nil, err
+	}
+	msg := chat.NewMessage(chat.TypeDirect, sealed)
+	if len(msg.Body) > chat.MaxBodySize {
+		return nil, errors.New("the message is too long")
+	}
+	msg.To = recipient
+	msg.Enc = chat.EncryptionBox
+	return msg, nil
+}
+
+// Decrypt a direct message in place. Messages sent by the user on other
+// sessions are decrypted using the key agreement methods of the recipient.
+func (s *session) decrypt(msg *chat.Message) error {
+	if msg.Enc != chat.EncryptionBox {
+		return fmt.Errorf("unsupported encryption scheme: %s", msg.Enc)
+	}
+	if msg.Sender == nil {
+		return errors.New("unknown sender")
+	}
+	if s.agreement == nil {
+		return fmt.Errorf("received from %s, an agreement key is required to read direct messages", msg.Sender.Label())
+	}
+	peer := msg.Sender.DID
+	if peer == s.did {
+		peer = msg.To
+	}
+	keys, err := s.agreementKeys(peer)
+	if err != nil {
+		return err
+	}
+	body, err := openDirect(msg.Body, keys, s.agreement)
+	if err != nil {
+		return fmt.Errorf("received from %s, %s", msg.Sender.Label(), err)
+	}
+	msg.Body = body
+	return nil
+}
+
+// Return the DID for a recipient of a direct message.
+func (s *session) peer(to string) (string, error) {
+	if strings.HasPrefix(to, "did:") {
+		return to, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.peers[to]
+	if !ok {
+		return "", fmt.Errorf("unknown user '%s', use the DID instead", to)
+	}
+	if id == "" {
+		return "", fmt.Errorf("more than one user is named '%s', use the DID instead", to)
+	}
+	return id, nil
+}
+
+// Record the identities included in a message received from the service.
+// Names used by more than one DID are kept empty, as they are ambiguous.
+func (s *session) learn(msg *chat.Message) {
+	ids := []*chat.Identity{msg.Sender}
+	for _, r := range msg.Rooms {
+		ids = append(ids, r.Members...)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		if id == nil || id.DID == "" || id.Name == "" {
+			continue
+		}
+		if prev, ok := s.peers[id.Name]; !ok {
+			s.peers[id.Name] = id.DID
+		} else if prev != id.DID {
+			s.peers[id.Name] = ""
+		}
+	}
+}
+
+// Return the key agreement methods for the DID, resolved only once per
+// session.
+func (s *session) agreementKeys(id string) ([]*agreementKey, error) {
+	s.mu.Lock()
+	keys, ok := s.keys[id]
+	s.mu.Unlock()
+	if ok {
+		return keys, nil
+	}
+	keys, err := resolveAgreementKeys(s.resolver, id)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.keys[id] = keys
+	s.mu.Unlock()
+	return keys, nil
+}
+
+// Send a message to the service, using the legacy text format if the
+// JSON protocol was not negotiated.
+func (s *session) send(msg *chat.Message) error {
+	frame := msg.Encode()
+	if s.legacy() {
+		body := msg.Body
+		if msg.Type == chat.TypeLeave {
+			body = "is going away"
+		}
+		frame = []byte(fmt.Sprintf("%s: %s", s.alias, body))
+	}
+	return s.ws.WriteMessage(websocket.TextMessage, frame)
+}
+
+// Display a message, verified senders are shown with a marker next to
+// their name.
+func (s *session) print(msg *chat.Message, alias string) {
+	sender, own := alias, alias == s.alias
+	if msg.Sender != nil && msg.Sender.DID != "" {
+		sender = fmt.Sprintf("%s %s", msg.Sender.Label(), aurora.Green("✓"))
+		own = msg.Sender.DID == s.did
+	}
+	name := aurora.Blue(sender)
+	if own {
+		name = aurora.Yellow(sender)
+	}
+	ts := ""
+	if !msg.Timestamp.IsZero() {
+		ts = fmt.Sprintf("[%s] ", msg.Timestamp.Local().Format("15:04"))
+	}
+	if msg.Room != "" {
+		ts = fmt.Sprintf("%s%s ", ts, aurora.Cyan(s.roomLabel(msg.Room)))
+	}
+	switch msg.Type {
+	case chat.TypeJoin:
+		fmt.Fprintf(s.rl.Stdout(), "%s%s %s\n", ts, aurora.Green(sender), "joined the room")
+	case chat.TypeLeave:
+		if s.legacy() {
+			fmt.Fprintf(s.rl.Stdout(), "%s%s %s\n", ts, aurora.Red(sender), "is going away")
+			return
+		}
+		fmt.Fprintf(s.rl.Stdout(), "%s%s %s\n", ts, aurora.Red(sender), "left the room")
+	case chat.TypeList:
+		for _, r := range msg.Rooms {
+			joined := ""
+			if r.Joined {
+				joined = " (joined)"
+			}
+			fmt.Fprintf(s.rl.Stdout(), "%s: %d member(s)%s\n", aurora.Cyan(s.roomLabel(r.Name)), r.Size, joined)
+			for _, m := range r.Members {
+				fmt.Fprintf(s.rl.Stdout(), "  %s %s\n", m.Label(), aurora.Green("✓"))
+			}
+		}
+	case chat.TypeDirect:
+		to := "you"
+		if own {
+			to = msg.To
+		}
+		fmt.Fprintf(s.rl.Stdout(), "%s%s → %s %s: %s\n", ts, name, aurora.Magenta(to), aurora.Green("🔒"), msg.Body)
+	case chat.TypeError:
+		fmt.Fprintf(s.rl.Stdout(), "%s%s\n", ts, aurora.Red(msg.Body))
+	default:
+		fmt.Fprintf(s.rl.Stdout(), "%s%s: %s\n", ts, name, msg.Body)
+	}
+}
+
+// Display name for a room, the service's default room when empty.
+func (s *session) roomLabel(room string) string {
+	if room == "" {
+		return "default"
+	}
+	return "#" + room
+}
+
+// Check if the service uses the legacy text format.
+func (s *session) legacy() bool {
+	return s.ws.Subprotocol() != chat.Protocol
 }
 
 func init() {
@@ -91,13 +386,50 @@ func init() {
 			FlagKey:   "connect.cert",
 			ByDefault: "",
 		},
+		{
+			Name:      "key",
+			Usage:     "private key for the user certificate, by default the '.pem' file next to it",
+			FlagKey:   "connect.key",
+			ByDefault: "",
+		},
+		{
+			Name:      "ca",
+			Usage:     "CA certificate(s) used to verify the service, by default the system pool plus 'root-ca.crt' if present",
+			FlagKey:   "connect.ca",
+			ByDefault: "",
+		},
+		{
+			Name:      "pin",
+			Usage:     "expected fingerprint for the service's public key ('sha256/<base64>')",
+			FlagKey:   "connect.pin",
+			ByDefault: "",
+		},
+		{
+			Name:      "known-hosts",
+			Usage:     "enable trust-on-first-use, recording service key fingerprints in the provided file",
+			FlagKey:   "connect.known-hosts",
+			ByDefault: "",
+		},
+		{
+			Name:      "renew-before",
+			Usage:     "offer to renew the certificate when it expires within the provided period",
+			FlagKey:   "connect.renew-before",
+			ByDefault: "72h",
+		},
 		{
 			Name:      "alias",
-			Usage:     "alias for the session",
+			Usage:     "alias for the session, only used with services that don't verify senders",
 			FlagKey:   "connect.alias",
 			ByDefault: name,
 		},
+		{
+			Name:      "agreement-key",
+			Usage:     "file containing the hex-encoded private key for a key agreement method of your DID, used to encrypt direct messages; a 64 bytes Ed25519 key is also accepted for 'did:key' identifiers",
+			FlagKey:   "connect.agreement-key",
+			ByDefault: "",
+		},
 	}
+	params = append(params, resolverParams("connect")...)
 	if err := cli.SetupCommandParams(connectCmd, params); err != nil {
 		panic(err)
 	}
@@ -113,24 +445,106 @@ func runClient(cmd *cobra.Command, args []string) error {
 		return errors.New("you need to provide your user certificate")
 	}
 
-	// Load certificate
-	c, err := ioutil.ReadFile(viper.GetString("connect.cert"))
+	// Load certificate and private key
+	certFile := viper.GetString("connect.cert")
+	keyFile := viper.GetString("connect.key")
+	if keyFile == "" {
+		keyFile = strings.TrimSuffix(certFile, filepath.Ext(certFile)) + ".pem"
+	}
+	c, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return err
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	// Verify the service identity
+	u, err := url.Parse(args[0])
+	if err != nil {
+		return err
+	}
+	trust := &serverTrust{
+		ca:         viper.GetString("connect.ca"),
+		pin:        viper.GetString("connect.pin"),
+		knownHosts: viper.GetString("connect.known-hosts"),
+	}
+	tlsConf, err := trust.config(u.Host)
+	if err != nil {
+		return err
+	}
+
+	// Offer to renew the certificate when it's about to expire
+	cert, err := parseCertificate(c)
+	if err != nil {
+		return err
+	}
+	if remaining := time.Until(cert.NotAfter); remaining < viper.GetDuration("connect.renew-before") {
+		fmt.Printf("the certificate expires in %s, renew now? [y/N] ", remaining.Round(time.Minute))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(answer)) == "y" {
+			if _, err = renewCertificate(serviceURL(u), certFile, keyFile, tlsConf); err != nil {
+				return err
+			}
+			if c, err = ioutil.ReadFile(certFile); err != nil {
+				return err
+			}
+			if pair, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+				return err
+			}
+			log.Println("certificate renewed successfully!")
+		}
+	}
+	tlsConf.Certificates = []tls.Certificate{pair}
+
+	// Direct messages are end-to-end encrypted, the agreement key must
+	// belong to the DID in the certificate
+	resolver, err := getResolver("connect")
 	if err != nil {
 		return err
 	}
+	var agreement *[32]byte
+	if file := viper.GetString("connect.agreement-key"); file != "" {
+		if certificateDID(cert) == "" {
+			return errors.New("the certificate doesn't include a DID")
+		}
+		if agreement, err = loadAgreementKey(file); err != nil {
+			return err
+		}
+		keys, err := resolveAgreementKeys(resolver, certificateDID(cert))
+		if err != nil {
+			return err
+		}
+		if err = matchAgreementKey(agreement, keys); err != nil {
+			return err
+		}
+	}
+
+	// The certificate is presented during the TLS handshake, it's also
+	// sent as a header for deployments behind a TLS-terminating ingress
 	endpoint := fmt.Sprintf("%s/connect", args[0])
- 	headers := make(http.Header)
- 	headers.Set("X-user-certificate", base64.StdEncoding.EncodeToString(c))
+	headers := make(http.Header)
+	headers.Set("X-user-certificate", base64.StdEncoding.EncodeToString(c))
 	dialer := websocket.Dialer{
-		Proxy: http.ProxyFromEnvironment,
-		TLSClientConfig:&tls.Config{
-			InsecureSkipVerify: true,
-		},
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConf,
+		Subprotocols:    []string{chat.Protocol},
 	}
 	ws, _, err := dialer.Dial(endpoint, headers)
 	if err != nil {
 		return err
 	}
+
+	// Complete proof-of-possession handshake
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("unsupported private key type")
+	}
+	if err = provePossession(ws, key, u.Host); err != nil {
+		ws.Close()
+		return err
+	}
 	rl, err := readline.NewEx(&readline.Config{
 		Prompt:          fmt.Sprintf("%s", aurora.Magenta("» ")),
 		InterruptPrompt: "^C",
@@ -141,12 +555,29 @@ func runClient(cmd *cobra.Command, args []string) error {
 	}
 	defer rl.Close()
 	sess := &session{
-		alias:   viper.GetString("connect.alias"),
-		ws:      ws,
-		rl:      rl,
-		errChan: make(chan error),
+		alias:     viper.GetString("connect.alias"),
+		did:       certificateDID(cert),
+		ws:        ws,
+		rl:        rl,
+		errChan:   make(chan error),
+		resolver:  resolver,
+		agreement: agreement,
+		peers:     make(map[string]string),
+		keys:      make(map[string][]*agreementKey),
 	}
 	go sess.readConsole()
 	go sess.readWebsocket()
 	return <-sess.errChan
 }
+
+// Return the HTTP endpoint for a websocket service URL.
+func serviceURL(u *url.URL) string {
+	su := *u
+	switch su.Scheme {
+	case "ws":
+		su.Scheme = "http"
+	case "wss":
+		su.Scheme = "https"
+	}
+	return strings.TrimSuffix(su.String(), "/")
+}
@@ -0,0 +1,226 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// Certificate request in the JSON format used by the CA tooling, i.e.
+// the format produced by subject templates and the '*_csr.json' files.
+type csrRequest struct {
+	CN    string    `json:"cn"`
+	Hosts []string  `json:"hosts,omitempty"`
+	URIs  []string  `json:"uris,omitempty"`
+	Key   *csrKey   `json:"key,omitempty"`
+	Names []csrName `json:"names,omitempty"`
+}
+
+// Key specification for a certificate request.
+type csrKey struct {
+	Algo string `json:"algo"`
+	Size int    `json:"size"`
+}
+
+// Subject attributes for a certificate request.
+type csrName struct {
+	C  string `json:"c,omitempty"`
+	ST string `json:"st,omitempty"`
+	L  string `json:"l,omitempty"`
+	O  string `json:"o,omitempty"`
+	OU string `json:"ou,omitempty"`
+	SA string `json:"sa,omitempty"`
+	PC string `json:"pc,omitempty"`
+}
+
+func decodeCSRRequest(data []byte) (*csrRequest, error) {
+	req := &csrRequest{}
+	if err := json.Unmarshal(data, req); err != nil {
+		return nil, err
+	}
+	if req.CN == "" {
+		return nil, errors.New("a 'cn' value is required in the certificate request")
+	}
+	return req, nil
+}
+
+// Subject to use for certificates issued for the request.
+func (cr *csrRequest) subject() pkix.Name {
+	name := pkix.Name{CommonName: cr.CN}
+	for _, n := range cr.Names {
+		appendNonEmpty(&name.Country, n.C)
+		appendNonEmpty(&name.Province, n.ST)
+		appendNonEmpty(&name.Locality, n.L)
+		appendNonEmpty(&name.Organization, n.O)
+		appendNonEmpty(&name.OrganizationalUnit, n.OU)
+		appendNonEmpty(&name.StreetAddress, n.SA)
+		appendNonEmpty(&name.PostalCode, n.PC)
+	}
+	return name
+}
+
+// URI SAN values for certificates issued for the request.
+func (cr *csrRequest) uris() ([]*url.URL, error) {
+	var list []*url.URL
+	for _, el := range cr.URIs {
+		u, err := url.Parse(el)
+		if err != nil || u.Scheme == "" {
+			return nil, fmt.Errorf("invalid URI value: %s", el)
+		}
+		list = append(list, u)
+	}
+	return list, nil
+}
+
+// Verify the provided public key satisfies the key specification of the
+// request. ECDSA keys must use the exact curve requested, RSA keys must
+// be at least of the requested size.
+func (cr *csrRequest) checkKey(pub crypto.PublicKey) error {
+	if cr.Key == nil {
+		return nil
+	}
+	switch cr.Key.Algo {
+	case "ecdsa":
+		k, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("an ECDSA key is required")
+		}
+		if k.Curve.Params().BitSize != cr.Key.Size {
+			return fmt.Errorf("an ECDSA key of size %d is required", cr.Key.Size)
+		}
+	case "rsa":
+		k, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("a RSA key is required")
+		}
+		if k.N.BitLen() < cr.Key.Size {
+			return fmt.Errorf("a RSA key of at least %d bits is required", cr.Key.Size)
+		}
+	default:
+		return fmt.Errorf("unsupported key algorithm: %s", cr.Key.Algo)
+	}
+	return nil
+}
+
+// Generate a new private key based on the provided specification.
+func generateKey(spec *csrKey) (crypto.Signer, error) {
+	switch spec.Algo {
+	case "ecdsa":
+		var curve elliptic.Curve
+		switch spec.Size {
+		case 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("invalid ECDSA key size: %d", spec.Size)
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	case "rsa":
+		if spec.Size < 2048 {
+			return nil, fmt.Errorf("invalid RSA key size: %d", spec.Size)
+		}
+		return rsa.GenerateKey(rand.Reader, spec.Size)
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm: %s", spec.Algo)
+	}
+}
+
+// Return the specification matching an existing public key.
+func publicKeySpec(pub crypto.PublicKey) (*csrKey, error) {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return &csrKey{Algo: "ecdsa", Size: k.Curve.Params().BitSize}, nil
+	case *rsa.PublicKey:
+		return &csrKey{Algo: "rsa", Size: k.N.BitLen()}, nil
+	default:
+		return nil, errors.New("unsupported public key type")
+	}
+}
+
+// Decode a PEM-encoded PKCS#10 certificate request and verify its
+// signature, as proof of possession of the corresponding private key.
+func parseCSR(data []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("invalid PEM certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, errors.New("invalid certificate request signature")
+	}
+	return csr, nil
+}
+
+// Generate a PEM-encoded PKCS#10 certificate request signed by the key.
+func newCSR(key crypto.Signer, cn string) ([]byte, error) {
+	tpl := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: cn},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tpl, key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// PEM-encode a private key.
+func encodePrivateKey(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	case *rsa.PrivateKey:
+		der := x509.MarshalPKCS1PrivateKey(k)
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der}), nil
+	default:
+		return nil, errors.New("unsupported private key type")
+	}
+}
+
+// Decode a PEM-encoded private key, in any of the PKCS#1, SEC1 or
+// PKCS#8 formats.
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid PEM private key")
+	}
+	if k, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("unsupported private key format")
+	}
+	signer, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	return signer, nil
+}
+
+func appendNonEmpty(list *[]string, value string) {
+	if value != "" {
+		*list = append(*list, value)
+	}
+}
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bryk-io/x/did"
+)
+
+// Multicodec prefixes for Ed25519 and X25519 public keys.
+var (
+	ed25519PubCodec = []byte{0xed, 0x01}
+	x25519PubCodec  = []byte{0xec, 0x01}
+)
+
+// Resolve 'did:key' identifiers. The document is derived directly from
+// the public key encoded in the identifier, no registry is required. The
+// X25519 key agreement key is derived from the Ed25519 key.
+// https://w3c-ccg.github.io/did-method-key/
+type keyResolver struct{}
+
+func (r *keyResolver) Resolve(id *did.Identifier) ([]byte, error) {
+	pub, err := decodeKeyDID(id.Subject())
+	if err != nil {
+		return nil, err
+	}
+	kid := fmt.Sprintf("%s#%s", id.String(), id.Subject())
+	xpub, err := ed25519PublicToX25519(pub)
+	if err != nil {
+		return nil, err
+	}
+	xkey := "z" + base58Encode(append(append([]byte{}, x25519PubCodec...), xpub...))
+	doc := map[string]interface{}{
+		"@context": []string{"https://w3id.org/did/v1"},
+		"id":       id.String(),
+		"publicKey": []map[string]string{
+			{
+				"id":              kid,
+				"type":            "Ed25519VerificationKey2018",
+				"controller":      id.String(),
+				"publicKeyHex":    hex.EncodeToString(pub),
+				"publicKeyBase58": base58Encode(pub),
+			},
+		},
+		"authentication": []string{kid},
+		"keyAgreement": []map[string]string{
+			{
+				"id":              fmt.Sprintf("%s#%s", id.String(), xkey),
+				"type":            x25519KeyType,
+				"controller":      id.String(),
+				"publicKeyBase58": base58Encode(xpub),
+			},
+		},
+	}
+	return json.Marshal(doc)
+}
+
+// Decode the Ed25519 public key from a 'did:key' method-specific identifier.
+func decodeKeyDID(subject string) ([]byte, error) {
+	if !strings.HasPrefix(subject, "z") {
+		return nil, errors.New("unsupported multibase encoding for 'did:key'")
+	}
+	raw, err := base58Decode(subject[1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != 34 || raw[0] != ed25519PubCodec[0] || raw[1] != ed25519PubCodec[1] {
+		return nil, errors.New("only Ed25519 keys are supported for 'did:key'")
+	}
+	return raw[2:], nil
+}
+
+// Resolve 'did:web' identifiers by retrieving the DID document from the
+// domain's '/.well-known/did.json' location, or from '<path>/did.json'
+// when the identifier includes path segments.
+// https://w3c-ccg.github.io/did-method-web/
+type webResolver struct {
+	client *http.Client
+}
+
+func (r *webResolver) Resolve(id *did.Identifier) ([]byte, error) {
+	location, err := webDocumentURL(id.Subject())
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to retrieve DID document from %s: %s", location, res.Status)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// Return the location of the DID document for a 'did:web' identifier.
+func webDocumentURL(subject string) (string, error) {
+	segments := strings.Split(subject, ":")
+	for i, s := range segments {
+		v, err := url.PathUnescape(s)
+		if err != nil || v == "" {
+			return "", errors.New("invalid 'did:web' identifier")
+		}
+		segments[i] = v
+	}
+	if len(segments) == 1 {
+		return fmt.Sprintf("https://%s/.well-known/did.json", segments[0]), nil
+	}
+	return fmt.Sprintf("https://%s/%s/did.json", segments[0], strings.Join(segments[1:], "/")), nil
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// Decode a base58 (bitcoin alphabet) encoded value.
+func base58Decode(value string) ([]byte, error) {
+	n := big.NewInt(0)
+	radix := big.NewInt(58)
+	for _, c := range value {
+		i := strings.IndexRune(base58Alphabet, c)
+		if i < 0 {
+			return nil, fmt.Errorf("invalid base58 character: %q", c)
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(i)))
+	}
+
+	// Leading '1' characters represent zero bytes
+	zeros := 0
+	for zeros < len(value) && value[zeros] == '1' {
+		zeros++
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
+
+// Encode a value using base58 (bitcoin alphabet).
+func base58Encode(value []byte) string {
+	n := new(big.Int).SetBytes(value)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+
+	// Leading zero bytes are represented as '1' characters
+	for i := 0; i < len(value) && value[i] == 0; i++ {
+		out = append(out, '1')
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
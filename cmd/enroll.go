@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
@@ -9,6 +10,9 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"time"
 
 	"github.com/bryk-io/x/cli"
 	"github.com/bryk-io/x/did"
@@ -17,14 +21,15 @@ import (
 )
 
 type enrollmentRequest struct {
-	Did       string           `json:"did"`
-	Challenge string           `json:"challenge"`
-	Signature *did.SignatureLD `json:"signature"`
+	Did       string            `json:"did"`
+	Challenge string            `json:"challenge"`
+	Signature *did.SignatureLD  `json:"signature"`
+	CSR       []byte            `json:"csr"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
 }
 
 type enrollmentResponse struct {
 	Cert []byte `json:"cert"`
-	Key  []byte `json:"key"`
 }
 
 var enrollCmd = &cobra.Command{
@@ -37,10 +42,6 @@ var enrollCmd = &cobra.Command{
 		if userDID == "" {
 			return errors.New("DID value is required")
 		}
-		challenge := viper.GetString("enroll.challenge")
-		if challenge == "" {
-			return errors.New("a challenge value is required")
-		}
 		signature := viper.GetString("enroll.signature")
 		if signature == "" {
 			return errors.New("a signature file is required")
@@ -49,14 +50,35 @@ var enrollCmd = &cobra.Command{
 		if endpoint == "" {
 			return errors.New("you need to specify the service endpoint to use")
 		}
+		metadata, err := parseMetadata(viper.GetString("enroll.metadata"))
+		if err != nil {
+			return err
+		}
 
 		// Resolve DID
 		log.Println("retrieving DID...")
-		id, err := resolveDID(userDID)
+		resolver, err := getResolver("enroll")
+		if err != nil {
+			return err
+		}
+		id, doc, err := resolveDocument(resolver, userDID)
 		if err != nil {
 			return err
 		}
 
+		// Request a challenge from the service
+		log.Println("requesting enrollment challenge...")
+		challenge, err := requestChallenge(endpoint, id.String())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\nsign the following challenge with your DID key:\n\n  %s\n\n", challenge.Value)
+		fmt.Printf("the challenge expires at: %s\n", challenge.Expires.Local().Format(time.RFC822))
+		fmt.Printf("press 'enter' once the signature is stored in '%s' ", signature)
+		if _, err = bufio.NewReader(os.Stdin).ReadString('\n'); err != nil {
+			return err
+		}
+
 		// Load signature
 		log.Println("loading challenge signature...")
 		sigJSON, err := ioutil.ReadFile(signature)
@@ -70,7 +92,23 @@ var enrollCmd = &cobra.Command{
 
 		// Verify challenge on the client side
 		log.Println("verifying challenge signature...")
-		if err = verifySignature(id, challenge, sigLD); err != nil {
+		if err = verifySignature(id, doc, challenge.Value, sigLD); err != nil {
+			return err
+		}
+
+		// Generate private key and certificate request, using the key
+		// specification advertised by the service
+		log.Println("generating private key...")
+		spec := challenge.Key
+		if spec == nil {
+			spec = &csrKey{Algo: "ecdsa", Size: 521}
+		}
+		key, err := generateKey(spec)
+		if err != nil {
+			return err
+		}
+		csr, err := newCSR(key, id.String())
+		if err != nil {
 			return err
 		}
 
@@ -78,8 +116,10 @@ var enrollCmd = &cobra.Command{
 		log.Println("submitting enrollment request...")
 		req := &enrollmentRequest{
 			Did:       id.String(),
-			Challenge: challenge,
+			Challenge: challenge.Value,
 			Signature: sigLD,
+			CSR:       csr,
+			Metadata:  metadata,
 		}
 		js, _ := json.MarshalIndent(req, "", "  ")
 		fmt.Printf("%s", js)
@@ -105,11 +145,14 @@ var enrollCmd = &cobra.Command{
 		log.Println("saving obtained certificate...")
 		creds := sr.Response.(map[string]interface{})
 		cert, _ := base64.StdEncoding.DecodeString(creds["cert"].(string))
-		key, _ := base64.StdEncoding.DecodeString(creds["key"].(string))
+		keyPEM, err := encodePrivateKey(key)
+		if err != nil {
+			return err
+		}
 		if err = ioutil.WriteFile(fmt.Sprintf("%s.crt", id.Subject()), cert, 0400); err != nil {
 			return err
 		}
-		if err = ioutil.WriteFile(fmt.Sprintf("%s.pem", id.Subject()), key, 0400); err != nil {
+		if err = ioutil.WriteFile(fmt.Sprintf("%s.pem", id.Subject()), keyPEM, 0400); err != nil {
 			return err
 		}
 		log.Println("certificate saved successfully!")
@@ -125,15 +168,9 @@ func init() {
 			FlagKey:   "enroll.did",
 			ByDefault: "",
 		},
-		{
-			Name:      "challenge",
-			Usage:     "challenge value used for authentication during the enrollment process",
-			FlagKey:   "enroll.challenge",
-			ByDefault: "",
-		},
 		{
 			Name:      "signature",
-			Usage:     "signature produced for authentication",
+			Usage:     "file to load the signature produced for the enrollment challenge from",
 			FlagKey:   "enroll.signature",
 			ByDefault: "",
 		},
@@ -143,9 +180,42 @@ func init() {
 			FlagKey:   "enroll.endpoint",
 			ByDefault: "",
 		},
+		{
+			Name:      "metadata",
+			Usage:     "metadata to include in the request, as comma-separated 'key=value' pairs",
+			FlagKey:   "enroll.metadata",
+			ByDefault: "",
+		},
 	}
+	params = append(params, resolverParams("enroll")...)
 	if err := cli.SetupCommandParams(enrollCmd, params); err != nil {
 		panic(err)
 	}
 	rootCmd.AddCommand(enrollCmd)
 }
+
+// Retrieve a new enrollment challenge for the DID from the service.
+func requestChallenge(endpoint, id string) (*challenge, error) {
+	res, err := http.Get(fmt.Sprintf("%s/challenge?did=%s", endpoint, url.QueryEscape(id)))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	sr := &serviceResponse{}
+	if err = json.Unmarshal(body, sr); err != nil {
+		return nil, err
+	}
+	if !sr.Ok {
+		return nil, fmt.Errorf("failed to obtain challenge: %v", sr.Response)
+	}
+	c := &challenge{}
+	js, _ := json.Marshal(sr.Response)
+	if err = json.Unmarshal(js, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
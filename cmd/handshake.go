@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Time allowed to complete the proof-of-possession handshake.
+const handshakeTimeout = 10 * time.Second
+
+// Label for the TLS exporter value bound to the proof of possession.
+const handshakeExporterLabel = "EXPORTER-suss-workshop-connect"
+
+// First frame sent by the server on new websocket connections. When
+// 'binding' is set the proof must include the TLS exporter value for
+// the connection.
+type handshakeChallenge struct {
+	Nonce   []byte `json:"nonce"`
+	Binding bool   `json:"binding"`
+}
+
+// Client reply to the handshake challenge.
+type handshakeResponse struct {
+	Signature []byte `json:"signature"`
+}
+
+// Require the client to prove it holds the private key for the
+// certificate it presented. The server sends a random nonce as the first
+// frame and the client must reply with a signature for it, bound to the
+// service host and, when TLS terminates at the server, to the connection.
+// On failure the connection is closed with a 'policy violation' code.
+func requestProof(conn *websocket.Conn, cert *x509.Certificate, host string, state *tls.ConnectionState) error {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	binding, err := channelBinding(state)
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	if err := conn.WriteJSON(&handshakeChallenge{Nonce: nonce, Binding: binding != nil}); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	res := &handshakeResponse{}
+	if err := conn.ReadJSON(res); err != nil {
+		closeConn(conn, websocket.ClosePolicyViolation, "invalid handshake response")
+		return err
+	}
+	if err := verifyKeySignature(cert.PublicKey, proofDigest(nonce, host, binding), res.Signature); err != nil {
+		closeConn(conn, websocket.ClosePolicyViolation, "proof of possession failed")
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	conn.SetWriteDeadline(time.Time{})
+	return nil
+}
+
+// Reply to the server's handshake challenge using the key of the
+// certificate presented by the client. 'host' is the service host the
+// client intended to connect to.
+func provePossession(conn *websocket.Conn, key crypto.Signer, host string) error {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	ch := &handshakeChallenge{}
+	if err := conn.ReadJSON(ch); err != nil {
+		if ce, ok := err.(*websocket.CloseError); ok {
+			return errors.New("connection rejected by the server: " + ce.Text)
+		}
+		return err
+	}
+	var binding []byte
+	if ch.Binding {
+		tc, ok := conn.UnderlyingConn().(*tls.Conn)
+		if !ok {
+			return errors.New("the server requires a TLS connection")
+		}
+		state := tc.ConnectionState()
+		b, err := channelBinding(&state)
+		if err != nil {
+			return err
+		}
+		binding = b
+	}
+	sig, err := key.Sign(rand.Reader, proofDigest(ch.Nonce, host, binding), crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	return conn.WriteJSON(&handshakeResponse{Signature: sig})
+}
+
+// Digest signed by the client, the nonce is bound to its purpose, the
+// service host and the TLS channel, so a signature relayed by a different
+// service can't be reused in a different context or connection.
+func proofDigest(nonce []byte, host string, binding []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("suss-workshop/connect:"))
+	h.Write(nonce)
+	h.Write([]byte(strings.ToLower(host)))
+	h.Write([]byte{0})
+	h.Write(binding)
+	return h.Sum(nil)
+}
+
+// Return the TLS exporter value for the connection, nil when the
+// connection is not using TLS.
+func channelBinding(state *tls.ConnectionState) ([]byte, error) {
+	if state == nil {
+		return nil, nil
+	}
+	return state.ExportKeyingMaterial(handshakeExporterLabel, nil, 32)
+}
+
+// Verify a signature produced with 'crypto.Signer' over a SHA-256 digest.
+func verifyKeySignature(pub crypto.PublicKey, digest, sig []byte) error {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		es := struct {
+			R, S *big.Int
+		}{}
+		if _, err := asn1.Unmarshal(sig, &es); err != nil {
+			return errors.New("invalid signature")
+		}
+		if !ecdsa.Verify(k, digest, es.R, es.S) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig); err != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return errors.New("unsupported public key type")
+	}
+}
+
+// Send a close frame with the provided code and reason and close the
+// underlying connection.
+func closeConn(conn *websocket.Conn, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	conn.Close()
+}
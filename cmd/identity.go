@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+)
+
+// Certificates issued for a DID include it as a URI SAN, along with the
+// 'didIdentity' extension binding the certificate to the contents of the
+// DID document at the time of issuance.
+var (
+	oidDIDIdentity = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 53240, 1}
+	oidSHA256      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+)
+
+// Contents of the identity extension:
+//
+//	DIDIdentity ::= SEQUENCE {
+//	  did             UTF8String,
+//	  digestAlgorithm AlgorithmIdentifier,
+//	  documentDigest  OCTET STRING }
+type didIdentity struct {
+	DID       string `asn1:"utf8"`
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+// Build the identity extension for the DID. The digest is calculated over
+// the JSON encoding of the document, with its keys sorted.
+func didExtension(id string, doc map[string]interface{}) (pkix.Extension, error) {
+	ext := pkix.Extension{Id: oidDIDIdentity}
+	js, err := json.Marshal(doc)
+	if err != nil {
+		return ext, err
+	}
+	digest := sha256.Sum256(js)
+	ext.Value, err = asn1.Marshal(didIdentity{
+		DID:       id,
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+		Digest:    digest[:],
+	})
+	return ext, err
+}
+
+// Return the contents of the identity extension, 'nil' if the certificate
+// doesn't include it.
+func certificateIdentity(cert *x509.Certificate) (*didIdentity, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidDIDIdentity) {
+			continue
+		}
+		id := &didIdentity{}
+		if rest, err := asn1.Unmarshal(ext.Value, id); err != nil || len(rest) > 0 {
+			return nil, errors.New("invalid DID identity extension")
+		}
+		return id, nil
+	}
+	return nil, nil
+}
+
+// Return the DID the certificate was issued for, taken from its URI SAN.
+// The common name is never used, since subject templates and other CAs
+// in the trust bundle are free to set it to any value.
+func certificateDID(cert *x509.Certificate) string {
+	for _, u := range cert.URIs {
+		if u.Scheme == "did" {
+			return u.String()
+		}
+	}
+	return ""
+}
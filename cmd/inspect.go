@@ -0,0 +1,490 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bryk-io/x/cli"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "Display the contents of certificates, chains and certificate requests",
+	Long: `Display the contents of certificates, chains and certificate requests
+
+Supported inputs are PEM or DER encoded certificates, optionally followed
+by their chain, PEM or DER encoded PKCS#10 requests and certificate requests
+in the JSON format used by the CA tooling.`,
+	Example: "suss-workshop inspect user.crt --verify",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("you need to provide the file to inspect")
+		}
+		data, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		report, err := inspect(data)
+		if err != nil {
+			return err
+		}
+
+		// Verify contents
+		if viper.GetBool("inspect.verify") {
+			if err = report.verify(viper.GetString("inspect.profile")); err != nil {
+				return err
+			}
+		}
+
+		// Print results
+		if viper.GetBool("inspect.json") {
+			js, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\n", js)
+		} else {
+			report.print()
+		}
+		if report.Verification != nil && !report.Verification.Valid {
+			return errors.New("verification failed")
+		}
+		return nil
+	},
+}
+
+func init() {
+	params := []cli.Param{
+		{
+			Name:      "verify",
+			Usage:     "validate certificates against the configured CA, and the signature of PKCS#10 requests",
+			FlagKey:   "inspect.verify",
+			ByDefault: false,
+		},
+		{
+			Name:      "profile",
+			Usage:     "signing profile providing the usages required when verifying certificates",
+			FlagKey:   "inspect.profile",
+			ByDefault: "user",
+		},
+		{
+			Name:      "json",
+			Usage:     "produce JSON output",
+			FlagKey:   "inspect.json",
+			ByDefault: false,
+		},
+	}
+	if err := cli.SetupCommandParams(inspectCmd, params); err != nil {
+		panic(err)
+	}
+	rootCmd.AddCommand(inspectCmd)
+}
+
+// Names for well-known extensions.
+var extensionNames = map[string]string{
+	"2.5.29.14":             "subject key identifier",
+	"2.5.29.15":             "key usage",
+	"2.5.29.17":             "subject alternative name",
+	"2.5.29.19":             "basic constraints",
+	"2.5.29.30":             "name constraints",
+	"2.5.29.31":             "crl distribution points",
+	"2.5.29.32":             "certificate policies",
+	"2.5.29.35":             "authority key identifier",
+	"2.5.29.37":             "extended key usage",
+	"1.3.6.1.5.5.7.1.1":     "authority information access",
+	oidDIDIdentity.String(): "did identity",
+}
+
+type inspectReport struct {
+	Type         string              `json:"type"`
+	Certificates []*certSummary      `json:"certificates,omitempty"`
+	Request      *requestSummary     `json:"request,omitempty"`
+	Verification *verificationResult `json:"verification,omitempty"`
+
+	certs []*x509.Certificate
+	csr   *x509.CertificateRequest
+}
+
+type certSummary struct {
+	Serial       string              `json:"serial"`
+	Subject      string              `json:"subject"`
+	Issuer       string              `json:"issuer"`
+	DID          string              `json:"did,omitempty"`
+	DNSNames     []string            `json:"dns_names,omitempty"`
+	URIs         []string            `json:"uris,omitempty"`
+	Emails       []string            `json:"emails,omitempty"`
+	IPs          []string            `json:"ips,omitempty"`
+	NotBefore    time.Time           `json:"not_before"`
+	NotAfter     time.Time           `json:"not_after"`
+	IsCA         bool                `json:"is_ca"`
+	PublicKey    string              `json:"public_key"`
+	Usages       []string            `json:"usages,omitempty"`
+	Policies     []string            `json:"policies,omitempty"`
+	OCSP         []string            `json:"ocsp,omitempty"`
+	CRL          []string            `json:"crl,omitempty"`
+	Identity     *identitySummary    `json:"identity,omitempty"`
+	Extensions   []*extensionSummary `json:"extensions,omitempty"`
+	SelfSigned   bool                `json:"self_signed"`
+	validityNote string
+}
+
+type identitySummary struct {
+	DID       string `json:"did"`
+	Algorithm string `json:"algorithm"`
+	Digest    string `json:"digest"`
+}
+
+type extensionSummary struct {
+	ID       string `json:"id"`
+	Name     string `json:"name,omitempty"`
+	Critical bool   `json:"critical"`
+	Value    string `json:"value,omitempty"`
+}
+
+type requestSummary struct {
+	Subject   string    `json:"subject"`
+	DID       string    `json:"did,omitempty"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+	URIs      []string  `json:"uris,omitempty"`
+	PublicKey string    `json:"public_key,omitempty"`
+	Key       *csrKey   `json:"key,omitempty"`
+	Names     []csrName `json:"names,omitempty"`
+}
+
+type verificationResult struct {
+	Valid   bool   `json:"valid"`
+	Profile string `json:"profile,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Decode the provided contents.
+func inspect(data []byte) (*inspectReport, error) {
+	// JSON certificate request
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		req, err := decodeCSRRequest(data)
+		if err != nil {
+			return nil, err
+		}
+		return &inspectReport{Type: "csr-json", Request: summarizeRequest(req)}, nil
+	}
+
+	// PEM blocks, DER contents otherwise
+	var certs, csrs [][]byte
+	for rest := data; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			certs = append(certs, block.Bytes)
+		case "CERTIFICATE REQUEST", "NEW CERTIFICATE REQUEST":
+			csrs = append(csrs, block.Bytes)
+		}
+	}
+	if len(certs) == 0 && len(csrs) == 0 {
+		if _, err := x509.ParseCertificate(data); err == nil {
+			certs = append(certs, data)
+		} else if _, err := x509.ParseCertificateRequest(data); err == nil {
+			csrs = append(csrs, data)
+		}
+	}
+
+	switch {
+	case len(certs) > 0:
+		report := &inspectReport{Type: "certificate"}
+		if len(certs) > 1 {
+			report.Type = "chain"
+		}
+		for _, der := range certs {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, err
+			}
+			report.certs = append(report.certs, cert)
+			report.Certificates = append(report.Certificates, summarizeCertificate(cert))
+		}
+		return report, nil
+	case len(csrs) > 0:
+		csr, err := x509.ParseCertificateRequest(csrs[0])
+		if err != nil {
+			return nil, err
+		}
+		return &inspectReport{Type: "csr", Request: summarizeCSR(csr), csr: csr}, nil
+	default:
+		return nil, errors.New("no certificates or certificate requests found")
+	}
+}
+
+// Validate certificates against the CA using the same options as the
+// server, and the signature of PKCS#10 requests. Verification failures
+// are included in the report.
+func (r *inspectReport) verify(profile string) error {
+	res := &verificationResult{}
+	switch r.Type {
+	case "certificate", "chain":
+		ca, err := getVerifierCA()
+		if err != nil {
+			return err
+		}
+		if _, err = ca.profile(profile); err != nil {
+			return err
+		}
+		res.Profile = profile
+		var chain []byte
+		for _, c := range r.certs {
+			chain = append(chain, pemCertificate(c)...)
+		}
+		if _, err = ca.verifyCertificate(chain, profile); err != nil {
+			res.Error = err.Error()
+		}
+	case "csr":
+		if err := r.csr.CheckSignature(); err != nil {
+			res.Error = err.Error()
+		}
+	default:
+		return errors.New("verification is not available for JSON certificate requests")
+	}
+	res.Valid = res.Error == ""
+	r.Verification = res
+	return nil
+}
+
+func (r *inspectReport) print() {
+	for i, c := range r.Certificates {
+		if i > 0 {
+			fmt.Println()
+		}
+		if len(r.Certificates) > 1 {
+			fmt.Printf("[%d]\n", i)
+		}
+		c.print()
+	}
+	if r.Request != nil {
+		r.Request.print()
+	}
+	if v := r.Verification; v != nil {
+		fmt.Println()
+		if v.Valid {
+			printField("verification", "ok")
+		} else {
+			printField("verification", fmt.Sprintf("failed, %s", v.Error))
+		}
+		if v.Profile != "" {
+			printField("profile", v.Profile)
+		}
+	}
+}
+
+func (c *certSummary) print() {
+	printField("serial", c.Serial)
+	printField("subject", c.Subject)
+	printField("issuer", c.Issuer)
+	printField("did", c.DID)
+	printField("dns names", strings.Join(c.DNSNames, ", "))
+	printField("uris", strings.Join(c.URIs, ", "))
+	printField("emails", strings.Join(c.Emails, ", "))
+	printField("ips", strings.Join(c.IPs, ", "))
+	printField("not before", c.NotBefore.Local().Format(time.RFC822))
+	printField("not after", fmt.Sprintf("%s%s", c.NotAfter.Local().Format(time.RFC822), c.validityNote))
+	printField("ca", fmt.Sprintf("%v", c.IsCA))
+	if c.SelfSigned {
+		printField("self-signed", "true")
+	}
+	printField("public key", c.PublicKey)
+	printField("usages", strings.Join(c.Usages, ", "))
+	printField("policies", strings.Join(c.Policies, ", "))
+	printField("ocsp", strings.Join(c.OCSP, ", "))
+	printField("crl", strings.Join(c.CRL, ", "))
+	if c.Identity != nil {
+		printField("identity", fmt.Sprintf("%s (%s %s)", c.Identity.DID, c.Identity.Algorithm, c.Identity.Digest))
+	}
+	for _, ext := range c.Extensions {
+		desc := ext.ID
+		if ext.Name != "" {
+			desc = fmt.Sprintf("%s (%s)", ext.Name, ext.ID)
+		}
+		if ext.Critical {
+			desc += ", critical"
+		}
+		if ext.Value != "" {
+			desc += ": " + ext.Value
+		}
+		printField("extension", desc)
+	}
+}
+
+func (r *requestSummary) print() {
+	printField("subject", r.Subject)
+	printField("did", r.DID)
+	printField("dns names", strings.Join(r.DNSNames, ", "))
+	printField("uris", strings.Join(r.URIs, ", "))
+	printField("public key", r.PublicKey)
+	if r.Key != nil {
+		printField("key", fmt.Sprintf("%s %d", r.Key.Algo, r.Key.Size))
+	}
+}
+
+// Print a labeled value, empty values are omitted.
+func printField(label, value string) {
+	if value == "" {
+		return
+	}
+	fmt.Printf("%-13s %s\n", label+":", value)
+}
+
+func summarizeCertificate(cert *x509.Certificate) *certSummary {
+	cs := &certSummary{
+		Serial:     formatSerial(cert.SerialNumber),
+		Subject:    cert.Subject.String(),
+		Issuer:     cert.Issuer.String(),
+		DID:        certificateDID(cert),
+		DNSNames:   cert.DNSNames,
+		Emails:     cert.EmailAddresses,
+		NotBefore:  cert.NotBefore,
+		NotAfter:   cert.NotAfter,
+		IsCA:       cert.IsCA,
+		PublicKey:  describePublicKey(cert.PublicKey),
+		Usages:     certificateUsages(cert),
+		OCSP:       cert.OCSPServer,
+		CRL:        cert.CRLDistributionPoints,
+		SelfSigned: bytes.Equal(cert.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(cert) == nil,
+	}
+	for _, u := range cert.URIs {
+		cs.URIs = append(cs.URIs, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		cs.IPs = append(cs.IPs, ip.String())
+	}
+	for _, p := range cert.PolicyIdentifiers {
+		cs.Policies = append(cs.Policies, p.String())
+	}
+	now := time.Now()
+	switch {
+	case now.After(cert.NotAfter):
+		cs.validityNote = " (expired)"
+	case now.Before(cert.NotBefore):
+		cs.validityNote = " (not yet valid)"
+	default:
+		cs.validityNote = fmt.Sprintf(" (%s left)", time.Until(cert.NotAfter).Round(time.Minute))
+	}
+
+	// Extensions, the contents are included for the ones not already
+	// decoded
+	id, err := certificateIdentity(cert)
+	if id != nil {
+		cs.Identity = &identitySummary{
+			DID:       id.DID,
+			Algorithm: digestName(id.Algorithm),
+			Digest:    hex.EncodeToString(id.Digest),
+		}
+	}
+	for _, ext := range cert.Extensions {
+		es := &extensionSummary{
+			ID:       ext.Id.String(),
+			Name:     extensionNames[ext.Id.String()],
+			Critical: ext.Critical,
+		}
+		if es.Name == "" || (ext.Id.Equal(oidDIDIdentity) && err != nil) {
+			es.Value = hex.EncodeToString(ext.Value)
+		}
+		cs.Extensions = append(cs.Extensions, es)
+	}
+	return cs
+}
+
+func summarizeCSR(csr *x509.CertificateRequest) *requestSummary {
+	rs := &requestSummary{
+		Subject:   csr.Subject.String(),
+		DNSNames:  csr.DNSNames,
+		PublicKey: describePublicKey(csr.PublicKey),
+	}
+	for _, u := range csr.URIs {
+		rs.URIs = append(rs.URIs, u.String())
+		if u.Scheme == "did" && rs.DID == "" {
+			rs.DID = u.String()
+		}
+	}
+	if rs.DID == "" && strings.HasPrefix(csr.Subject.CommonName, "did:") {
+		rs.DID = csr.Subject.CommonName
+	}
+	return rs
+}
+
+func summarizeRequest(req *csrRequest) *requestSummary {
+	rs := &requestSummary{
+		Subject:  req.subject().String(),
+		DNSNames: req.Hosts,
+		URIs:     req.URIs,
+		Key:      req.Key,
+		Names:    req.Names,
+	}
+	for _, u := range req.URIs {
+		if strings.HasPrefix(u, "did:") {
+			rs.DID = u
+			break
+		}
+	}
+	if rs.DID == "" && strings.HasPrefix(req.CN, "did:") {
+		rs.DID = req.CN
+	}
+	return rs
+}
+
+// Return the usages in the certificate, using the names supported in
+// signing profiles.
+func certificateUsages(cert *x509.Certificate) []string {
+	var list []string
+	for name, ku := range keyUsages {
+		if name != "signing" && cert.KeyUsage&ku != 0 {
+			list = append(list, name)
+		}
+	}
+	for _, eku := range cert.ExtKeyUsage {
+		name := ""
+		for n, u := range extKeyUsages {
+			if u == eku && (name == "" || n < name) {
+				name = n
+			}
+		}
+		list = append(list, name)
+	}
+	for _, oid := range cert.UnknownExtKeyUsage {
+		list = append(list, oid.String())
+	}
+	sort.Strings(list)
+	return list
+}
+
+func describePublicKey(pub crypto.PublicKey) string {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ecdsa %s", k.Curve.Params().Name)
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa %d", k.N.BitLen())
+	default:
+		return fmt.Sprintf("%T", pub)
+	}
+}
+
+func digestName(algo pkix.AlgorithmIdentifier) string {
+	if algo.Algorithm.Equal(oidSHA256) {
+		return "sha256"
+	}
+	return algo.Algorithm.String()
+}
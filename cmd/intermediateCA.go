@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/bryk-io/x/cli"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var intermediateCACmd = &cobra.Command{
+	Use:     "intermediate-ca",
+	Short:   "Create an intermediate certificate authority signed by the root CA",
+	Example: "suss-workshop intermediate-ca intermediate_ca_csr.json",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("you need to provide the CSR json file")
+		}
+		csrJSON, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		req, err := decodeCSRRequest(csrJSON)
+		if err != nil {
+			return err
+		}
+		if req.Key == nil {
+			req.Key = &csrKey{Algo: "ecdsa", Size: 256}
+		}
+
+		// The root key is only required here
+		root, err := getRootCA()
+		if err != nil {
+			return err
+		}
+		key, err := generateKey(req.Key)
+		if err != nil {
+			return err
+		}
+		cert, err := root.signCSR(&x509.CertificateRequest{PublicKey: key.Public()}, req, viper.GetString("intermediate-ca.profile"))
+		if err != nil {
+			return err
+		}
+		keyPEM, err := encodeCAKey(key, viper.GetBool("intermediate-ca.encrypt"))
+		if err != nil {
+			return err
+		}
+		out := viper.GetString("intermediate-ca.output")
+		if err = writeOutput(out, defaultIntermediateCert, cert); err != nil {
+			return err
+		}
+		if err = writeOutput(out, defaultIntermediateKey, keyPEM); err != nil {
+			return err
+		}
+		fmt.Println("intermediate-ca created")
+		fmt.Printf("use it to issue certificates with: --ca-cert %s --ca-key %s\n", filepath.Join(out, defaultIntermediateCert), filepath.Join(out, defaultIntermediateKey))
+		return nil
+	},
+}
+
+func init() {
+	params := []cli.Param{
+		{
+			Name:      "encrypt",
+			Usage:     "encrypt the CA private key with a passphrase",
+			FlagKey:   "intermediate-ca.encrypt",
+			ByDefault: false,
+		},
+		{
+			Name:      "profile",
+			Usage:     "signing profile to use for the intermediate CA certificate",
+			FlagKey:   "intermediate-ca.profile",
+			ByDefault: "intermediate",
+		},
+		{
+			Name:      "output",
+			Usage:     "directory to store the generated CA certificate and private key",
+			FlagKey:   "intermediate-ca.output",
+			ByDefault: ".",
+		},
+	}
+	if err := cli.SetupCommandParams(intermediateCACmd, params); err != nil {
+		panic(err)
+	}
+	rootCmd.AddCommand(intermediateCACmd)
+}
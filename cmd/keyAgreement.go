@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Direct messages are end-to-end encrypted using NaCl box, with the X25519
+// key agreement keys published in the DID documents of both participants.
+// Opening a box requires the public key of the sender, so decrypting a
+// message also authenticates it was produced by the holder of a key
+// agreement key of the sender's DID.
+
+// Type for X25519 key agreement methods in DID documents.
+const x25519KeyType = "X25519KeyAgreementKey2019"
+
+// Key agreement method published in a DID document.
+type agreementKey struct {
+	ID  string
+	Pub *[32]byte
+}
+
+// Resolve the DID and return its usable key agreement methods.
+func resolveAgreementKeys(r Resolver, value string) ([]*agreementKey, error) {
+	id, doc, err := resolveDocument(r, value)
+	if err != nil {
+		return nil, err
+	}
+	keys := agreementKeys(doc)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s has no usable key agreement method", id.String())
+	}
+	return keys, nil
+}
+
+// Return the X25519 key agreement methods in the DID document. Entries in
+// 'keyAgreement' can be embedded methods or references to keys listed in
+// 'publicKey' or 'verificationMethod'; unsupported entries are ignored.
+func agreementKeys(doc map[string]interface{}) []*agreementKey {
+	id, _ := doc["id"].(string)
+	methods := make(map[string]map[string]interface{})
+	for _, section := range []string{"publicKey", "verificationMethod"} {
+		list, _ := doc[section].([]interface{})
+		for _, entry := range list {
+			if m, ok := entry.(map[string]interface{}); ok {
+				kid, _ := m["id"].(string)
+				methods[absoluteKeyID(id, kid)] = m
+			}
+		}
+	}
+	var keys []*agreementKey
+	list, _ := doc["keyAgreement"].([]interface{})
+	for _, entry := range list {
+		m, ok := entry.(map[string]interface{})
+		if ref, isRef := entry.(string); isRef {
+			m, ok = methods[absoluteKeyID(id, ref)]
+		}
+		if !ok {
+			continue
+		}
+		if k := parseAgreementKey(id, m); k != nil {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// Decode an X25519 key agreement method, nil if not supported.
+func parseAgreementKey(id string, m map[string]interface{}) *agreementKey {
+	if t, _ := m["type"].(string); t != x25519KeyType {
+		return nil
+	}
+	var (
+		pub []byte
+		err error
+	)
+	if v, ok := m["publicKeyBase58"].(string); ok {
+		pub, err = base58Decode(v)
+	} else if v, ok := m["publicKeyHex"].(string); ok {
+		pub, err = hex.DecodeString(v)
+	}
+	if err != nil || len(pub) != 32 {
+		return nil
+	}
+	kid, _ := m["id"].(string)
+	k := &agreementKey{ID: absoluteKeyID(id, kid), Pub: new([32]byte)}
+	copy(k.Pub[:], pub)
+	return k
+}
+
+// Key identifiers may be relative to the DID, i.e. '#key-1'.
+func absoluteKeyID(id, kid string) string {
+	if strings.HasPrefix(kid, "#") {
+		return id + kid
+	}
+	return kid
+}
+
+// Load a hex-encoded private key to use for key agreement. Either a 32
+// bytes X25519 private key or, for 'did:key' identifiers, the 64 bytes
+// Ed25519 private key of the DID.
+func loadAgreementKey(file string) (*[32]byte, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, errors.New("the agreement key must be hex-encoded")
+	}
+	priv := new([32]byte)
+	switch len(raw) {
+	case 32:
+		copy(priv[:], raw)
+	case 64:
+		copy(priv[:], ed25519PrivateToX25519(raw[:32]))
+	default:
+		return nil, errors.New("invalid agreement key size")
+	}
+	return priv, nil
+}
+
+// Verify the private key matches one of the key agreement methods.
+func matchAgreementKey(priv *[32]byte, keys []*agreementKey) error {
+	pub := new([32]byte)
+	curve25519.ScalarBaseMult(pub, priv)
+	for _, k := range keys {
+		if bytes.Equal(k.Pub[:], pub[:]) {
+			return nil
+		}
+	}
+	return errors.New("the agreement key doesn't match any key agreement method of the DID")
+}
+
+// Encrypt a direct message for the recipient, using its first usable key
+// agreement method. Returns the base64 encoding of the nonce followed by
+// the sealed message.
+func sealDirect(body string, to []*agreementKey, priv *[32]byte) (string, error) {
+	nonce := new([24]byte)
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+	sealed := box.Seal(nonce[:], []byte(body), nonce, to[0].Pub, priv)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt a direct message exchanged with the peer. Since the shared key
+// is the same on both ends, this works for messages received from the
+// peer as well as for messages sent to it.
+func openDirect(body string, peer []*agreementKey, priv *[32]byte) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(body)
+	if err != nil || len(sealed) < 24+box.Overhead {
+		return "", errors.New("invalid encrypted message")
+	}
+	nonce := new([24]byte)
+	copy(nonce[:], sealed[:24])
+	for _, k := range peer {
+		if plain, ok := box.Open(nil, sealed[24:], nonce, k.Pub, priv); ok {
+			return string(plain), nil
+		}
+	}
+	return "", errors.New("the message was not encrypted by a key agreement method of the sender")
+}
+
+// Convert an Ed25519 public key to its X25519 equivalent, mapping the
+// Edwards 'y' coordinate to the Montgomery 'u' coordinate as
+// u = (1 + y) / (1 - y) mod p.
+func ed25519PublicToX25519(pub []byte) ([]byte, error) {
+	if len(pub) != 32 {
+		return nil, errors.New("invalid Ed25519 public key")
+	}
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	le := make([]byte, 32)
+	copy(le, pub)
+	le[31] &= 0x7f
+	y := new(big.Int).SetBytes(reverseBytes(le))
+	den := new(big.Int).Sub(big.NewInt(1), y)
+	den.Mod(den, p)
+	if den.Sign() == 0 {
+		return nil, errors.New("invalid Ed25519 public key")
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, den.ModInverse(den, p))
+	u.Mod(u, p)
+	out := make([]byte, 32)
+	b := u.Bytes()
+	copy(out[32-len(b):], b)
+	return reverseBytes(out), nil
+}
+
+// Convert an Ed25519 private key seed to its X25519 equivalent.
+func ed25519PrivateToX25519(seed []byte) []byte {
+	h := sha512.Sum512(seed)
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+	return h[:32]
+}
+
+func reverseBytes(b []byte) []byte {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Derive the X25519 key agreement material for a new Ed25519 key pair.
+func testAgreementKey(t *testing.T, id string) (*[32]byte, []*agreementKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xPub, err := ed25519PublicToX25519(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xPriv := new([32]byte)
+	copy(xPriv[:], ed25519PrivateToX25519(priv.Seed()))
+	k := &agreementKey{ID: id + "#key-1", Pub: new([32]byte)}
+	copy(k.Pub[:], xPub)
+	return xPriv, []*agreementKey{k}
+}
+
+func TestEd25519ToX25519(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		priv, keys := testAgreementKey(t, "did:key:test")
+		expected := new([32]byte)
+		curve25519.ScalarBaseMult(expected, priv)
+		if !bytes.Equal(expected[:], keys[0].Pub[:]) {
+			t.Fatalf("public key mismatch: %x != %x", keys[0].Pub[:], expected[:])
+		}
+		if err := matchAgreementKey(priv, keys); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDirectRoundTrip(t *testing.T) {
+	alice, aliceKeys := testAgreementKey(t, "did:key:alice")
+	bob, bobKeys := testAgreementKey(t, "did:key:bob")
+	body := "meet at the usual place"
+
+	sealed, err := sealDirect(body, bobKeys, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Opened by the recipient
+	plain, err := openDirect(sealed, aliceKeys, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain != body {
+		t.Errorf("unexpected body: %s", plain)
+	}
+
+	// Opened by the sender, displaying the message on other sessions
+	plain, err = openDirect(sealed, bobKeys, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain != body {
+		t.Errorf("unexpected body: %s", plain)
+	}
+
+	// Nonces must not be reused
+	again, err := sealDirect(body, bobKeys, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == sealed {
+		t.Error("sealing the same message twice produced the same output")
+	}
+
+	// A third party can't open it, nor pass as the sender
+	eve, eveKeys := testAgreementKey(t, "did:key:eve")
+	if _, err = openDirect(sealed, aliceKeys, eve); err == nil {
+		t.Error("message opened by a third party")
+	}
+	if _, err = openDirect(sealed, eveKeys, bob); err == nil {
+		t.Error("message accepted from the wrong sender")
+	}
+}
+
+func TestDirectTampered(t *testing.T) {
+	alice, aliceKeys := testAgreementKey(t, "did:key:alice")
+	bob, bobKeys := testAgreementKey(t, "did:key:bob")
+	sealed, err := sealDirect("transfer 10 credits", bobKeys, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a bit on the nonce, the authenticator and the ciphertext
+	for _, i := range []int{0, 24, len(raw) - 1} {
+		tampered := append([]byte{}, raw...)
+		tampered[i] ^= 0x01
+		if _, err = openDirect(base64.StdEncoding.EncodeToString(tampered), aliceKeys, bob); err == nil {
+			t.Errorf("tampered message accepted, byte %d", i)
+		}
+	}
+
+	// Truncated and malformed inputs
+	for _, v := range []string{"", "not base64", base64.StdEncoding.EncodeToString(raw[:30])} {
+		if _, err = openDirect(v, aliceKeys, bob); err == nil {
+			t.Errorf("invalid message accepted: %q", v)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSP responder, as described in RFC 6960. Responses are signed either
+// directly by the CA or by a delegated responder certificate issued by
+// the CA for the 'ocsp signing' usage.
+type ocspResponder struct {
+	ca       *authority
+	registry *certRegistry
+	cert     *x509.Certificate
+	key      crypto.Signer
+	validity time.Duration
+}
+
+// Return a new responder instance, if no certificate is provided the
+// responses are signed using the CA key.
+func newOCSPResponder(ca *authority, reg *certRegistry, certFile, keyFile string, validity time.Duration) (*ocspResponder, error) {
+	o := &ocspResponder{
+		ca:       ca,
+		registry: reg,
+		cert:     ca.cert,
+		key:      ca.key,
+		validity: validity,
+	}
+	if certFile == "" {
+		return o, nil
+	}
+
+	// Load delegated responder
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	if o.cert, err = parseCertificate(certPEM); err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if o.key, err = parsePrivateKey(keyPEM); err != nil {
+		return nil, err
+	}
+	if err = o.cert.CheckSignatureFrom(ca.cert); err != nil {
+		return nil, errors.New("the OCSP responder certificate must be issued by the CA")
+	}
+	delegated := false
+	for _, u := range o.cert.ExtKeyUsage {
+		if u == x509.ExtKeyUsageOCSPSigning {
+			delegated = true
+		}
+	}
+	if !delegated {
+		return nil, errors.New("the OCSP responder certificate must include the 'ocsp signing' usage")
+	}
+	return o, nil
+}
+
+// OCSP
+// Requests are accepted as POST requests with a DER-encoded body, or
+// as GET requests with the base64 request appended to the URL path.
+func (o *ocspResponder) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	var (
+		der []byte
+		err error
+	)
+	switch req.Method {
+	case http.MethodGet:
+		var value string
+		value, err = url.PathUnescape(strings.TrimPrefix(req.URL.EscapedPath(), "/ocsp/"))
+		if err == nil {
+			der, err = base64.StdEncoding.DecodeString(value)
+		}
+	case http.MethodPost:
+		defer req.Body.Close()
+		der, err = ioutil.ReadAll(http.MaxBytesReader(res, req.Body, 10*1024))
+	}
+	if err != nil || len(der) == 0 {
+		o.write(res, ocsp.MalformedRequestErrorResponse, 0)
+		return
+	}
+	ocspReq, err := ocsp.ParseRequest(der)
+	if err != nil {
+		o.write(res, ocsp.MalformedRequestErrorResponse, 0)
+		return
+	}
+	if !o.issuedByCA(ocspReq) {
+		o.write(res, ocsp.UnauthorizedErrorResponse, 0)
+		return
+	}
+	resp, err := o.respond(ocspReq)
+	if err != nil {
+		log.Println(err.Error())
+		o.write(res, ocsp.InternalErrorErrorResponse, 0)
+		return
+	}
+	o.write(res, resp, o.validity)
+}
+
+// Produce a signed response for the request.
+func (o *ocspResponder) respond(req *ocsp.Request) ([]byte, error) {
+	now := time.Now().UTC().Truncate(time.Minute)
+	tpl := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(o.validity),
+	}
+	if o.cert != o.ca.cert {
+		tpl.Certificate = o.cert
+	}
+
+	// Certificates not in the registry, or issued by another CA of the
+	// service, are unknown to the responder
+	rec, err := o.registry.get(formatSerial(req.SerialNumber))
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		tpl.Status = ocsp.Unknown
+		return ocsp.CreateResponse(o.ca.cert, o.cert, tpl, o.key)
+	}
+	cert, err := parseCertificate(rec.Cert)
+	if err != nil {
+		return nil, err
+	}
+	if !issuedBy(cert, o.ca.cert) {
+		tpl.Status = ocsp.Unknown
+		return ocsp.CreateResponse(o.ca.cert, o.cert, tpl, o.key)
+	}
+	if rec.Revoked {
+		tpl.Status = ocsp.Revoked
+		tpl.RevokedAt = rec.RevokedAt.UTC()
+		tpl.RevocationReason = rec.Reason
+	}
+	return ocsp.CreateResponse(o.ca.cert, o.cert, tpl, o.key)
+}
+
+// Verify the request refers to a certificate issued by the signing CA.
+// Responses are only authoritative for that CA, as required by RFC 6960
+// section 4.2.2.2, so requests for any other issuer are rejected.
+func (o *ocspResponder) issuedByCA(req *ocsp.Request) bool {
+	if !req.HashAlgorithm.Available() {
+		return false
+	}
+	bits, err := publicKeyBits(o.ca.cert.RawSubjectPublicKeyInfo)
+	if err != nil {
+		return false
+	}
+	h := req.HashAlgorithm.New()
+	h.Write(o.ca.cert.RawSubject)
+	nameHash := h.Sum(nil)
+	h.Reset()
+	h.Write(bits)
+	keyHash := h.Sum(nil)
+	return bytes.Equal(nameHash, req.IssuerNameHash) && bytes.Equal(keyHash, req.IssuerKeyHash)
+}
+
+func (o *ocspResponder) write(res http.ResponseWriter, resp []byte, maxAge time.Duration) {
+	res.Header().Set("Content-Type", "application/ocsp-response")
+	if maxAge > 0 {
+		res.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, public", int(maxAge.Seconds())))
+	}
+	res.Write(resp)
+}
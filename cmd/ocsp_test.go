@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Issue a test certificate, self-signed when no parent is provided.
+func testCertificate(t *testing.T, cn string, parent *x509.Certificate, parentKey crypto.Signer, tpl *x509.Certificate) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl.SerialNumber = serial
+	tpl.Subject = pkix.Name{CommonName: cn}
+	tpl.NotBefore = time.Now().Add(-time.Hour)
+	tpl.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = tpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func testCATemplate() *x509.Certificate {
+	return &x509.Certificate{
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+}
+
+// Authority with a root and an intermediate signing CA.
+func testAuthority(t *testing.T) *authority {
+	t.Helper()
+	root, rootKey := testCertificate(t, "root", nil, nil, testCATemplate())
+	cert, key := testCertificate(t, "intermediate", root, rootKey, testCATemplate())
+	return &authority{
+		cert:  cert,
+		key:   key,
+		root:  root,
+		chain: []*x509.Certificate{cert},
+	}
+}
+
+func testRegistry(t *testing.T, dir string) *certRegistry {
+	t.Helper()
+	reg, err := openRegistry(filepath.Join(dir, "certs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+func TestOCSPResponder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ocsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := testAuthority(t)
+	reg := testRegistry(t, dir)
+
+	// Good, revoked and unknown certificates
+	userTpl := func() *x509.Certificate {
+		return &x509.Certificate{KeyUsage: x509.KeyUsageDigitalSignature}
+	}
+	good, _ := testCertificate(t, "good", ca.cert, ca.key, userTpl())
+	revoked, _ := testCertificate(t, "revoked", ca.cert, ca.key, userTpl())
+	unknown, _ := testCertificate(t, "unknown", ca.cert, ca.key, userTpl())
+	for _, c := range []*x509.Certificate{good, revoked} {
+		if err = reg.record(c, pemCertificate(c), "user", sourceEnroll, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	revokedAt := time.Now().UTC().Truncate(time.Second)
+	if err = reg.markRevoked(formatSerial(revoked.SerialNumber), revocationReasons["keyCompromise"], revokedAt); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delegated responder material
+	delegated, delegatedKey := testCertificate(t, "ocsp", ca.cert, ca.key, &x509.Certificate{
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+	})
+	keyPEM, err := encodePrivateKey(delegatedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "ocsp.crt"), filepath.Join(dir, "ocsp.pem")
+	if err = ioutil.WriteFile(certFile, pemCertificate(delegated), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	configs := []struct {
+		name              string
+		certFile, keyFile string
+	}{
+		{"direct", "", ""},
+		{"delegated", certFile, keyFile},
+	}
+	for _, conf := range configs {
+		t.Run(conf.name, func(t *testing.T) {
+			responder, err := newOCSPResponder(ca, reg, conf.certFile, conf.keyFile, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := httptest.NewServer(responder)
+			defer srv.Close()
+
+			cases := []struct {
+				cert   *x509.Certificate
+				status int
+			}{
+				{good, ocsp.Good},
+				{revoked, ocsp.Revoked},
+				{unknown, ocsp.Unknown},
+			}
+			for _, tc := range cases {
+				req, err := ocsp.CreateRequest(tc.cert, ca.cert, &ocsp.RequestOptions{Hash: crypto.SHA1})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, method := range []string{http.MethodGet, http.MethodPost} {
+					body := testOCSPQuery(t, srv.URL, method, req)
+					resp, err := ocsp.ParseResponseForCert(body, tc.cert, ca.cert)
+					if err != nil {
+						t.Fatalf("%s %s: %s", method, tc.cert.Subject.CommonName, err)
+					}
+					if resp.Status != tc.status {
+						t.Errorf("%s %s: unexpected status %d", method, tc.cert.Subject.CommonName, resp.Status)
+					}
+					if tc.status == ocsp.Revoked {
+						if !resp.RevokedAt.Equal(revokedAt) || resp.RevocationReason != ocsp.KeyCompromise {
+							t.Errorf("%s: unexpected revocation details", method)
+						}
+					}
+				}
+			}
+
+			// The responder is only authoritative for the signing CA
+			otherCA, otherKey := testCertificate(t, "other-ca", nil, nil, testCATemplate())
+			other, _ := testCertificate(t, "other", otherCA, otherKey, userTpl())
+			req, err := ocsp.CreateRequest(other, otherCA, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := testOCSPQuery(t, srv.URL, http.MethodPost, req)
+			if !bytes.Equal(body, ocsp.UnauthorizedErrorResponse) {
+				t.Error("request for another issuer was not rejected")
+			}
+		})
+	}
+}
+
+func testOCSPQuery(t *testing.T, endpoint, method string, req []byte) []byte {
+	t.Helper()
+	var (
+		res *http.Response
+		err error
+	)
+	if method == http.MethodGet {
+		res, err = http.Get(endpoint + "/ocsp/" + url.PathEscape(base64.StdEncoding.EncodeToString(req)))
+	} else {
+		res, err = http.Post(endpoint+"/ocsp", "application/ocsp-request", bytes.NewReader(req))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
@@ -0,0 +1,302 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Private keys are encrypted as PKCS#8 'EncryptedPrivateKeyInfo' using
+// PBES2 (RFC 8018) with scrypt (RFC 7914) and AES-256-CBC. PBKDF2 keys,
+// like the ones produced by 'openssl pkcs8 -topk8', can also be decrypted.
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// scrypt cost parameters used when encrypting keys, the same used by OpenSSL
+// by default so the keys can be handled with its tools.
+const (
+	scryptN      = 1 << 14
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algo          pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KDF    pkix.AlgorithmIdentifier
+	Scheme pkix.AlgorithmIdentifier
+}
+
+type scryptParams struct {
+	Salt   []byte
+	N      int
+	R      int
+	P      int
+	KeyLen int `asn1:"optional"`
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLen     int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// Encrypt a private key with the passphrase, returns a PEM-encoded
+// 'ENCRYPTED PRIVATE KEY' block.
+func encryptPrivateKey(key crypto.Signer, passphrase []byte) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Derive encryption key
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err = rand.Read(iv); err != nil {
+		return nil, err
+	}
+	k, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	// Encrypt contents
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	padLen := aes.BlockSize - len(der)%aes.BlockSize
+	data := append(der, bytes.Repeat([]byte{byte(padLen)}, padLen)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	// Encode PBES2 parameters
+	kdf, err := asn1.Marshal(scryptParams{
+		Salt:   salt,
+		N:      scryptN,
+		R:      scryptR,
+		P:      scryptP,
+		KeyLen: scryptKeyLen,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KDF:    pkix.AlgorithmIdentifier{Algorithm: oidScrypt, Parameters: asn1.RawValue{FullBytes: kdf}},
+		Scheme: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	res, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algo:          pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: res}), nil
+}
+
+// Decrypt a DER-encoded PKCS#8 'EncryptedPrivateKeyInfo' structure.
+func decryptPrivateKey(der, passphrase []byte) (crypto.Signer, error) {
+	info := encryptedPrivateKeyInfo{}
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, errors.New("invalid encrypted private key")
+	}
+	if !info.Algo.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported key encryption algorithm: %s", info.Algo.Algorithm)
+	}
+	params := pbes2Params{}
+	if _, err := asn1.Unmarshal(info.Algo.Parameters.FullBytes, &params); err != nil {
+		return nil, errors.New("invalid PBES2 parameters")
+	}
+
+	// Encryption scheme
+	var keyLen int
+	switch {
+	case params.Scheme.Algorithm.Equal(oidAES128CBC):
+		keyLen = 16
+	case params.Scheme.Algorithm.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("unsupported key encryption scheme: %s", params.Scheme.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.Scheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid encryption scheme parameters")
+	}
+
+	// Derive encryption key
+	var (
+		k   []byte
+		err error
+	)
+	switch {
+	case params.KDF.Algorithm.Equal(oidScrypt):
+		sp := scryptParams{}
+		if _, err = asn1.Unmarshal(params.KDF.Parameters.FullBytes, &sp); err != nil {
+			return nil, errors.New("invalid scrypt parameters")
+		}
+		if sp.KeyLen != 0 && sp.KeyLen != keyLen {
+			return nil, errors.New("invalid scrypt key length")
+		}
+		if k, err = scrypt.Key(passphrase, sp.Salt, sp.N, sp.R, sp.P, keyLen); err != nil {
+			return nil, err
+		}
+	case params.KDF.Algorithm.Equal(oidPBKDF2):
+		pp := pbkdf2Params{}
+		if _, err = asn1.Unmarshal(params.KDF.Parameters.FullBytes, &pp); err != nil {
+			return nil, errors.New("invalid PBKDF2 parameters")
+		}
+		var h func() hash.Hash
+		switch {
+		case len(pp.PRF.Algorithm) == 0, pp.PRF.Algorithm.Equal(oidHMACWithSHA1):
+			h = sha1.New
+		case pp.PRF.Algorithm.Equal(oidHMACWithSHA256):
+			h = sha256.New
+		default:
+			return nil, fmt.Errorf("unsupported PBKDF2 function: %s", pp.PRF.Algorithm)
+		}
+		k = pbkdf2.Key(passphrase, pp.Salt, pp.Iterations, keyLen, h)
+	default:
+		return nil, fmt.Errorf("unsupported key derivation function: %s", params.KDF.Algorithm)
+	}
+
+	// Decrypt contents
+	data := info.EncryptedData
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid encrypted private key")
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+	padLen := int(plain[len(plain)-1])
+	if padLen == 0 || padLen > aes.BlockSize ||
+		!hmac.Equal(plain[len(plain)-padLen:], bytes.Repeat([]byte{byte(padLen)}, padLen)) {
+		return nil, errors.New("invalid passphrase")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(plain[:len(plain)-padLen])
+	if err != nil {
+		return nil, errors.New("invalid passphrase")
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	return signer, nil
+}
+
+// Decode a PEM-encoded CA private key, requesting the passphrase if
+// it's encrypted.
+func unlockCAKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "ENCRYPTED PRIVATE KEY" {
+		return parsePrivateKey(data)
+	}
+	pp, err := caPassphrase("CA key passphrase", false)
+	if err != nil {
+		return nil, err
+	}
+	return decryptPrivateKey(block.Bytes, pp)
+}
+
+// Return the passphrase for the CA private key. It's taken from the
+// 'SUSS_CA_PASSPHRASE' env variable, the passphrase file or an interactive
+// prompt, in that order.
+func caPassphrase(prompt string, confirm bool) ([]byte, error) {
+	if pp := viper.GetString("ca.passphrase"); pp != "" {
+		return []byte(pp), nil
+	}
+	if file := viper.GetString("ca.passphrase-file"); file != "" {
+		pp, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(pp, "\r\n"), nil
+	}
+	return readPassphrase(prompt, confirm)
+}
+
+// Interactively request a passphrase, when 'confirm' is set the user must
+// provide the same value twice.
+func readPassphrase(prompt string, confirm bool) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, errors.New("a passphrase is required for the CA private key, use an interactive terminal, 'SUSS_CA_PASSPHRASE' or 'ca-passphrase-file'")
+	}
+	fmt.Fprintf(os.Stderr, "%s: ", prompt)
+	pp, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(pp) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	if !confirm {
+		return pp, nil
+	}
+	fmt.Fprintf(os.Stderr, "confirm %s: ", prompt)
+	again, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pp, again) {
+		return nil, errors.New("passphrases don't match")
+	}
+	return pp, nil
+}
+
+// Encode the CA private key, encrypted when 'encrypt' is set.
+func encodeCAKey(key crypto.Signer, encrypt bool) ([]byte, error) {
+	if !encrypt {
+		return encodePrivateKey(key)
+	}
+	pp, err := caPassphrase("passphrase for the new CA key", true)
+	if err != nil {
+		return nil, err
+	}
+	return encryptPrivateKey(key, pp)
+}
@@ -0,0 +1,318 @@
+// +build pkcs11
+
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+	"github.com/spf13/viper"
+)
+
+// Named curves supported for keys stored in PKCS#11 tokens.
+var pkcs11Curves = map[string]struct {
+	curve elliptic.Curve
+	oid   asn1.ObjectIdentifier
+}{
+	"P-256": {elliptic.P256(), asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}},
+	"P-384": {elliptic.P384(), asn1.ObjectIdentifier{1, 3, 132, 0, 34}},
+	"P-521": {elliptic.P521(), asn1.ObjectIdentifier{1, 3, 132, 0, 35}},
+}
+
+// DigestInfo prefixes for PKCS#1 v1.5 signatures, as defined in RFC 8017.
+var pkcs1Prefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA224: {0x30, 0x2d, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x04, 0x05, 0x00, 0x04, 0x1c},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// Private key stored in a PKCS#11 token, the key material never leaves
+// the device. Sessions can't be used concurrently so signing operations
+// are serialized.
+type pkcs11Key struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	handle  pkcs11.ObjectHandle
+	pub     crypto.PublicKey
+	mu      sync.Mutex
+}
+
+func (k *pkcs11Key) Public() crypto.PublicKey {
+	return k.pub
+}
+
+func (k *pkcs11Key) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var (
+		mech  uint
+		input []byte
+	)
+	switch k.pub.(type) {
+	case *ecdsa.PublicKey:
+		mech = pkcs11.CKM_ECDSA
+		input = digest
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return nil, errors.New("RSA-PSS signatures are not supported")
+		}
+		prefix, ok := pkcs1Prefixes[opts.HashFunc()]
+		if !ok {
+			return nil, errors.New("unsupported hash function")
+		}
+		mech = pkcs11.CKM_RSA_PKCS
+		input = append(append([]byte{}, prefix...), digest...)
+	default:
+		return nil, errors.New("unsupported key type in token")
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.ctx.SignInit(k.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mech, nil)}, k.handle); err != nil {
+		return nil, err
+	}
+	sig, err := k.ctx.Sign(k.session, input)
+	if err != nil {
+		return nil, err
+	}
+	if mech != pkcs11.CKM_ECDSA {
+		return sig, nil
+	}
+
+	// Tokens return ECDSA signatures as 'r || s'
+	half := len(sig) / 2
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{
+		new(big.Int).SetBytes(sig[:half]),
+		new(big.Int).SetBytes(sig[half:]),
+	})
+}
+
+// Return the key with the provided label from the configured token.
+func openPKCS11Key(label string) (crypto.Signer, error) {
+	ctx, session, err := pkcs11Session()
+	if err != nil {
+		return nil, err
+	}
+	priv, err := findPKCS11Object(ctx, session, pkcs11.CKO_PRIVATE_KEY, label)
+	if err != nil {
+		return nil, err
+	}
+	pubObj, err := findPKCS11Object(ctx, session, pkcs11.CKO_PUBLIC_KEY, label)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := pkcs11PublicKey(ctx, session, pubObj)
+	if err != nil {
+		return nil, err
+	}
+	return &pkcs11Key{
+		ctx:     ctx,
+		session: session,
+		handle:  priv,
+		pub:     pub,
+	}, nil
+}
+
+// Generate a new key pair inside the configured token. The private key is
+// marked as sensitive and non-extractable.
+func generatePKCS11Key(label string, spec *csrKey) (crypto.Signer, error) {
+	ctx, session, err := pkcs11Session()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = findPKCS11Object(ctx, session, pkcs11.CKO_PRIVATE_KEY, label); err == nil {
+		return nil, fmt.Errorf("a key labeled '%s' already exists in the token", label)
+	}
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		return nil, err
+	}
+	pubTpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	privTpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	var mech uint
+	switch spec.Algo {
+	case "ecdsa":
+		c, ok := pkcs11Curves[fmt.Sprintf("P-%d", spec.Size)]
+		if !ok {
+			return nil, fmt.Errorf("invalid ECDSA key size: %d", spec.Size)
+		}
+		params, err := asn1.Marshal(c.oid)
+		if err != nil {
+			return nil, err
+		}
+		mech = pkcs11.CKM_EC_KEY_PAIR_GEN
+		pubTpl = append(pubTpl, pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params))
+	case "rsa":
+		if spec.Size < 2048 {
+			return nil, fmt.Errorf("invalid RSA key size: %d", spec.Size)
+		}
+		mech = pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN
+		pubTpl = append(pubTpl,
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, spec.Size),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}))
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm: %s", spec.Algo)
+	}
+	pubObj, priv, err := ctx.GenerateKeyPair(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mech, nil)}, pubTpl, privTpl)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := pkcs11PublicKey(ctx, session, pubObj)
+	if err != nil {
+		return nil, err
+	}
+	return &pkcs11Key{
+		ctx:     ctx,
+		session: session,
+		handle:  priv,
+		pub:     pub,
+	}, nil
+}
+
+// Open an authenticated session with the configured module and slot. The
+// session is kept open for the lifetime of the process.
+func pkcs11Session() (*pkcs11.Ctx, pkcs11.SessionHandle, error) {
+	module := viper.GetString("ca.pkcs11.module")
+	if module == "" {
+		return nil, 0, errors.New("the PKCS#11 module is required, use 'ca-pkcs11-module'")
+	}
+	pin, err := pkcs11PIN()
+	if err != nil {
+		return nil, 0, err
+	}
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, 0, fmt.Errorf("failed to load PKCS#11 module: %s", module)
+	}
+	if err = ctx.Initialize(); err != nil {
+		if e, ok := err.(pkcs11.Error); !ok || e != pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED {
+			ctx.Destroy()
+			return nil, 0, err
+		}
+	}
+	slot := uint(viper.GetInt("ca.pkcs11.slot"))
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = ctx.Login(session, pkcs11.CKU_USER, pin); err != nil {
+		if e, ok := err.(pkcs11.Error); !ok || e != pkcs11.CKR_USER_ALREADY_LOGGED_IN {
+			ctx.CloseSession(session)
+			return nil, 0, err
+		}
+	}
+	return ctx, session, nil
+}
+
+// The token PIN is taken from the 'SUSS_CA_PKCS11_PIN' env variable or
+// the PIN file.
+func pkcs11PIN() (string, error) {
+	if pin := viper.GetString("ca.pkcs11.pin"); pin != "" {
+		return pin, nil
+	}
+	if file := viper.GetString("ca.pkcs11.pin-file"); file != "" {
+		pin, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(pin), "\r\n"), nil
+	}
+	return "", errors.New("the token PIN is required, use 'SUSS_CA_PKCS11_PIN' or 'ca-pkcs11-pin-file'")
+}
+
+func findPKCS11Object(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, class uint, label string) (pkcs11.ObjectHandle, error) {
+	tpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	if err := ctx.FindObjectsInit(session, tpl); err != nil {
+		return 0, err
+	}
+	defer ctx.FindObjectsFinal(session)
+	list, _, err := ctx.FindObjects(session, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(list) == 0 {
+		return 0, fmt.Errorf("key '%s' not found in the token", label)
+	}
+	return list[0], nil
+}
+
+// Return the public key for the object, EC keys are tried first falling
+// back to RSA.
+func pkcs11PublicKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, obj pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	attrs, err := ctx.GetAttributeValue(session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return pkcs11RSAPublicKey(ctx, session, obj)
+	}
+	oid := asn1.ObjectIdentifier{}
+	if _, err = asn1.Unmarshal(attrs[0].Value, &oid); err != nil {
+		return nil, errors.New("invalid EC parameters")
+	}
+	var curve elliptic.Curve
+	for _, c := range pkcs11Curves {
+		if c.oid.Equal(oid) {
+			curve = c.curve
+		}
+	}
+	if curve == nil {
+		return nil, fmt.Errorf("unsupported curve: %s", oid)
+	}
+
+	// The point is usually wrapped in an OCTET STRING
+	point := attrs[1].Value
+	var raw []byte
+	if rest, err := asn1.Unmarshal(point, &raw); err == nil && len(rest) == 0 {
+		point = raw
+	}
+	x, y := elliptic.Unmarshal(curve, point)
+	if x == nil {
+		return nil, errors.New("invalid EC point")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func pkcs11RSAPublicKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, obj pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	attrs, err := ctx.GetAttributeValue(session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return nil, errors.New("unsupported key type")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(attrs[0].Value),
+		E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+	}, nil
+}
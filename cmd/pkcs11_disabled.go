@@ -0,0 +1,18 @@
+// +build !pkcs11
+
+package cmd
+
+import (
+	"crypto"
+	"errors"
+)
+
+var errNoPKCS11 = errors.New("PKCS#11 support is not available, build with the 'pkcs11' tag")
+
+func openPKCS11Key(_ string) (crypto.Signer, error) {
+	return nil, errNoPKCS11
+}
+
+func generatePKCS11Key(_ string, _ *csrKey) (crypto.Signer, error) {
+	return nil, errNoPKCS11
+}
@@ -0,0 +1,284 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	certsBucket = []byte("certs")
+	didsBucket  = []byte("dids")
+	logBucket   = []byte("log")
+)
+
+// Issuance sources.
+const (
+	sourceEnroll   = "enroll"
+	sourceRenew    = "renew"
+	sourceUserCert = "user-cert"
+)
+
+// Registry entry for an issued certificate.
+type certRecord struct {
+	Serial    string            `json:"serial"`
+	DID       string            `json:"did"`
+	Profile   string            `json:"profile"`
+	Source    string            `json:"source"`
+	IssuedAt  time.Time         `json:"issued_at"`
+	NotBefore time.Time         `json:"not_before"`
+	NotAfter  time.Time         `json:"not_after"`
+	Revoked   bool              `json:"revoked"`
+	RevokedAt *time.Time        `json:"revoked_at,omitempty"`
+	Reason    int               `json:"reason,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Cert      []byte            `json:"cert"`
+}
+
+// Return the current status of the certificate: valid, expired,
+// not-yet-valid or revoked.
+func (cr *certRecord) status() string {
+	now := time.Now()
+	switch {
+	case cr.Revoked:
+		return "revoked"
+	case now.After(cr.NotAfter):
+		return "expired"
+	case now.Before(cr.NotBefore):
+		return "not-yet-valid"
+	default:
+		return "valid"
+	}
+}
+
+// Persistent registry of issued certificates, stored in an embedded
+// bbolt database. The database is only kept open for the duration of each
+// operation so it can be shared between a running server and the CLI.
+type certRegistry struct {
+	path string
+}
+
+func openRegistry(path string) (*certRegistry, error) {
+	cr := &certRegistry{path: path}
+	db, err := cr.open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{certsBucket, didsBucket, logBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return cr, err
+}
+
+func (cr *certRegistry) open() (*bolt.DB, error) {
+	db, err := bolt.Open(cr.path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, errors.New("certificates registry is locked by another process")
+	}
+	return db, err
+}
+
+// Register a newly issued certificate, along with the metadata provided
+// when it was requested. The certificate is also appended to the issuance
+// transparency log.
+func (cr *certRegistry) record(cert *x509.Certificate, pemCert []byte, profile, source string, md map[string]string) error {
+	rec := &certRecord{
+		Serial:    formatSerial(cert.SerialNumber),
+		DID:       certificateDID(cert),
+		Profile:   profile,
+		Source:    source,
+		IssuedAt:  time.Now().UTC(),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		Metadata:  md,
+		Cert:      pemCert,
+	}
+	db, err := cr.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := putRecord(tx, rec); err != nil {
+			return err
+		}
+		if err := appendLogEntry(tx, cert.Raw); err != nil {
+			return err
+		}
+		if rec.DID == "" {
+			return nil
+		}
+		idx, err := tx.Bucket(didsBucket).CreateBucketIfNotExists([]byte(rec.DID))
+		if err != nil {
+			return err
+		}
+		return idx.Put([]byte(rec.Serial), []byte{})
+	})
+}
+
+// Return the record for a given serial number, 'nil' if not found.
+func (cr *certRegistry) get(serial string) (*certRecord, error) {
+	var rec *certRecord
+	err := cr.view(func(tx *bolt.Tx) (err error) {
+		rec, err = getRecord(tx, serial)
+		return
+	})
+	return rec, err
+}
+
+// Return all the records for a given DID.
+func (cr *certRegistry) byDID(id string) ([]*certRecord, error) {
+	var list []*certRecord
+	err := cr.view(func(tx *bolt.Tx) error {
+		idx := tx.Bucket(didsBucket).Bucket([]byte(id))
+		if idx == nil {
+			return nil
+		}
+		return idx.ForEach(func(k, _ []byte) error {
+			rec, err := getRecord(tx, string(k))
+			if err != nil || rec == nil {
+				return err
+			}
+			list = append(list, rec)
+			return nil
+		})
+	})
+	sortRecords(list)
+	return list, err
+}
+
+// Return all the records matching the filter function, or all the
+// records available if no filter is provided.
+func (cr *certRegistry) list(filter func(*certRecord) bool) ([]*certRecord, error) {
+	var list []*certRecord
+	err := cr.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(certsBucket).ForEach(func(_, v []byte) error {
+			rec := &certRecord{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				return err
+			}
+			if filter == nil || filter(rec) {
+				list = append(list, rec)
+			}
+			return nil
+		})
+	})
+	sortRecords(list)
+	return list, err
+}
+
+// Return the records with a DID or serial number containing the query.
+func (cr *certRegistry) search(query string) ([]*certRecord, error) {
+	query = strings.ToLower(query)
+	return cr.list(func(rec *certRecord) bool {
+		return strings.Contains(strings.ToLower(rec.DID), query) || strings.HasPrefix(rec.Serial, query)
+	})
+}
+
+// Check if the DID currently holds a valid certificate.
+func (cr *certRegistry) hasValid(id string) (bool, error) {
+	list, err := cr.byDID(id)
+	if err != nil {
+		return false, err
+	}
+	for _, rec := range list {
+		if rec.status() == "valid" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Update the revocation status for a certificate.
+func (cr *certRegistry) markRevoked(serial string, reason int, at time.Time) error {
+	db, err := cr.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		rec, err := getRecord(tx, serial)
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			return errors.New("certificate not found in the registry")
+		}
+		if rec.Revoked {
+			return fmt.Errorf("already revoked on %s", rec.RevokedAt.Format(time.RFC822))
+		}
+		rec.Revoked = true
+		rec.RevokedAt = &at
+		rec.Reason = reason
+		return putRecord(tx, rec)
+	})
+}
+
+// Check if the certificate was revoked. Certificates not in the registry
+// were not issued by the service, so they are never reported as revoked.
+func (cr *certRegistry) isRevoked(cert *x509.Certificate) (bool, error) {
+	rec, err := cr.get(formatSerial(cert.SerialNumber))
+	if err != nil {
+		return false, err
+	}
+	return rec != nil && rec.Revoked, nil
+}
+
+// Check the record exists and holds exactly the certificate provided, so
+// certificates issued by other CAs, even for the same serial number, are
+// never mistaken for ones issued by the service.
+func issuedByService(rec *certRecord, cert *x509.Certificate) bool {
+	if rec == nil {
+		return false
+	}
+	stored, err := parseCertificate(rec.Cert)
+	return err == nil && stored.Equal(cert)
+}
+
+func (cr *certRegistry) view(fn func(tx *bolt.Tx) error) error {
+	db, err := cr.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+func getRecord(tx *bolt.Tx, serial string) (*certRecord, error) {
+	v := tx.Bucket(certsBucket).Get([]byte(serial))
+	if v == nil {
+		return nil, nil
+	}
+	rec := &certRecord{}
+	if err := json.Unmarshal(v, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func putRecord(tx *bolt.Tx, rec *certRecord) error {
+	v, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(certsBucket).Put([]byte(rec.Serial), v)
+}
+
+// Most recently issued first.
+func sortRecords(list []*certRecord) {
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].IssuedAt.After(list[j].IssuedAt)
+	})
+}
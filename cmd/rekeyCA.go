@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/bryk-io/x/cli"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var rekeyCACmd = &cobra.Command{
+	Use:     "rekey-ca",
+	Short:   "Change the passphrase used to encrypt a CA private key",
+	Example: "suss-workshop rekey-ca root-ca.pem",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// By default use the root CA private key
+		keyFile := viper.GetString("ca.root-key")
+		if len(args) > 0 {
+			keyFile = args[0]
+		}
+		if strings.HasPrefix(keyFile, base64Prefix) {
+			return errors.New("you need to provide the location of the private key file")
+		}
+		if _, ok := pkcs11Label(keyFile); ok {
+			return errors.New("keys stored in a PKCS#11 token are protected by the token PIN")
+		}
+		info, err := os.Stat(keyFile)
+		if err != nil {
+			return err
+		}
+
+		// Unlock with the current passphrase, if any
+		keyPEM, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return err
+		}
+		key, err := unlockCAKey(keyPEM)
+		if err != nil {
+			return err
+		}
+
+		// Encrypt with the new passphrase
+		var pp []byte
+		if file := viper.GetString("rekey-ca.new-passphrase-file"); file != "" {
+			if pp, err = ioutil.ReadFile(file); err != nil {
+				return err
+			}
+			pp = bytes.TrimRight(pp, "\r\n")
+		} else if pp, err = readPassphrase("new CA key passphrase", true); err != nil {
+			return err
+		}
+		if len(pp) == 0 {
+			return errors.New("empty passphrase")
+		}
+		keyPEM, err = encryptPrivateKey(key, pp)
+		if err != nil {
+			return err
+		}
+		if err = replaceFile(keyFile, keyPEM, info.Mode().Perm()); err != nil {
+			return err
+		}
+		fmt.Println("CA private key updated")
+		return nil
+	},
+}
+
+func init() {
+	params := []cli.Param{
+		{
+			Name:      "new-passphrase-file",
+			Usage:     "file containing the new passphrase, by default it's requested interactively",
+			FlagKey:   "rekey-ca.new-passphrase-file",
+			ByDefault: "",
+		},
+	}
+	if err := cli.SetupCommandParams(rekeyCACmd, params); err != nil {
+		panic(err)
+	}
+	rootCmd.AddCommand(rekeyCACmd)
+}
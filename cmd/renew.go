@@ -0,0 +1,246 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bryk-io/x/cli"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var renewCmd = &cobra.Command{
+	Use:     "renew",
+	Short:   "Obtain a replacement for a certificate that is about to expire",
+	Example: "suss-workshop renew --cert 4d81bd52.crt --endpoint https://suss.example.com",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Validate parameters
+		certFile := viper.GetString("renew.cert")
+		if certFile == "" {
+			return errors.New("you need to provide the certificate to renew")
+		}
+		endpoint := viper.GetString("renew.endpoint")
+		if endpoint == "" {
+			return errors.New("you need to provide the service endpoint")
+		}
+		keyFile := viper.GetString("renew.key")
+		if keyFile == "" {
+			keyFile = strings.TrimSuffix(certFile, filepath.Ext(certFile)) + ".pem"
+		}
+
+		// Verify the service identity
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return err
+		}
+		trust := &serverTrust{
+			ca:         viper.GetString("renew.ca"),
+			pin:        viper.GetString("renew.pin"),
+			knownHosts: viper.GetString("renew.known-hosts"),
+		}
+		tlsConf, err := trust.config(u.Host)
+		if err != nil {
+			return err
+		}
+
+		log.Println("submitting renewal request...")
+		cert, err := renewCertificate(endpoint, certFile, keyFile, tlsConf)
+		if err != nil {
+			return err
+		}
+		log.Printf("certificate renewed, valid until %s\n", cert.NotAfter.Local().Format(time.RFC822))
+		return nil
+	},
+}
+
+// Renewal request, signed with the key of the certificate being replaced.
+type renewalRequest struct {
+	CSR       []byte `json:"csr"`
+	Signature []byte `json:"signature"`
+}
+
+func init() {
+	params := []cli.Param{
+		{
+			Name:      "cert",
+			Usage:     "certificate to renew",
+			FlagKey:   "renew.cert",
+			ByDefault: "",
+		},
+		{
+			Name:      "key",
+			Usage:     "private key for the certificate, by default the '.pem' file next to it",
+			FlagKey:   "renew.key",
+			ByDefault: "",
+		},
+		{
+			Name:      "endpoint",
+			Usage:     "service endpoint to send the renewal request to",
+			FlagKey:   "renew.endpoint",
+			ByDefault: "",
+		},
+		{
+			Name:      "ca",
+			Usage:     "CA certificate(s) used to verify the service, by default the system pool plus 'root-ca.crt' if present",
+			FlagKey:   "renew.ca",
+			ByDefault: "",
+		},
+		{
+			Name:      "pin",
+			Usage:     "expected fingerprint for the service's public key ('sha256/<base64>')",
+			FlagKey:   "renew.pin",
+			ByDefault: "",
+		},
+		{
+			Name:      "known-hosts",
+			Usage:     "enable trust-on-first-use, recording service key fingerprints in the provided file",
+			FlagKey:   "renew.known-hosts",
+			ByDefault: "",
+		},
+	}
+	if err := cli.SetupCommandParams(renewCmd, params); err != nil {
+		panic(err)
+	}
+	rootCmd.AddCommand(renewCmd)
+}
+
+// Request a replacement for the certificate and store it, along with
+// its new private key, in place of the current files.
+func renewCertificate(endpoint, certFile, keyFile string, tlsConf *tls.Config) (*x509.Certificate, error) {
+	// Load current credentials
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	current, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	cert, err := parseCertificate(certPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	// Generate a new key, using the same specification as the current
+	// one since both are issued with the same profile
+	spec, err := publicKeySpec(cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := generateKey(spec)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := newCSR(key, certificateDID(cert))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(csr)
+	sig, err := current.Sign(rand.Reader, renewalDigest(block.Bytes), crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	// Submit renewal request
+	js, _ := json.Marshal(&renewalRequest{
+		CSR:       csr,
+		Signature: sig,
+	})
+	conf := tlsConf.Clone()
+	conf.Certificates = []tls.Certificate{pair}
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: conf,
+		},
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/renew", endpoint), bytes.NewReader(js))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-user-certificate", base64.StdEncoding.EncodeToString(certPEM))
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	// Parse service response
+	sr := &serviceResponse{}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(body, sr); err != nil {
+		return nil, err
+	}
+	if !sr.Ok {
+		return nil, fmt.Errorf("renewal rejected: %v", sr.Response)
+	}
+	creds := sr.Response.(map[string]interface{})
+	renewed, _ := base64.StdEncoding.DecodeString(creds["cert"].(string))
+	newCert, err := parseCertificate(renewed)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Replace credentials, the current key is kept as a backup until both
+	// files are replaced so a failure never leaves a mismatched pair
+	currentKey, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	backup := keyFile + ".bak"
+	if err = replaceFile(backup, currentKey, 0400); err != nil {
+		return nil, err
+	}
+	if err = replaceFile(keyFile, keyPEM, 0400); err != nil {
+		os.Remove(backup)
+		return nil, err
+	}
+	if err = replaceFile(certFile, renewed, 0400); err != nil {
+		if rerr := replaceFile(keyFile, currentKey, 0400); rerr != nil {
+			return nil, fmt.Errorf("failed to replace the certificate: %s, the previous key is available in '%s'", err, backup)
+		}
+		os.Remove(backup)
+		return nil, err
+	}
+	os.Remove(backup)
+	return newCert, nil
+}
+
+// Digest signed with the current key, binding the new CSR to the
+// certificate being renewed.
+func renewalDigest(csrDER []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("suss-workshop/renew:"))
+	h.Write(csrDER)
+	return h.Sum(nil)
+}
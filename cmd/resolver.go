@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bryk-io/x/cli"
+	"github.com/bryk-io/x/did"
+	"github.com/spf13/viper"
+)
+
+// Resolver provides a mechanism to retrieve the DID document for a
+// given identifier.
+type Resolver interface {
+	// Return the JSON-encoded DID document for the identifier.
+	Resolve(id *did.Identifier) ([]byte, error)
+}
+
+// Dispatch resolution requests to the resolver registered for the
+// method of each identifier.
+type resolverRegistry struct {
+	methods map[string]Resolver
+}
+
+func newResolverRegistry() *resolverRegistry {
+	return &resolverRegistry{
+		methods: make(map[string]Resolver),
+	}
+}
+
+// Register the resolver to use for a given DID method.
+func (rr *resolverRegistry) Register(method string, r Resolver) {
+	rr.methods[method] = r
+}
+
+func (rr *resolverRegistry) Resolve(id *did.Identifier) ([]byte, error) {
+	r, ok := rr.methods[id.Method()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported DID method: %s", id.Method())
+	}
+	return r.Resolve(id)
+}
+
+// Retrieve DID documents from a remote registry over HTTP.
+type httpResolver struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (r *httpResolver) Resolve(id *did.Identifier) ([]byte, error) {
+	res, err := r.client.Get(fmt.Sprintf("%s?subject=%s", r.endpoint, url.QueryEscape(id.Subject())))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected registry response: %s", res.Status)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// Load DID documents from a local directory. Each document is stored
+// in a file named after the DID subject, i.e. '<subject>.json', with any
+// ':' character replaced by '_'.
+type localResolver struct {
+	dir string
+}
+
+func (r *localResolver) Resolve(id *did.Identifier) ([]byte, error) {
+	doc, err := ioutil.ReadFile(filepath.Join(r.dir, documentFile(id)))
+	if err != nil {
+		return nil, fmt.Errorf("no local document available for %s", id.String())
+	}
+	return doc, nil
+}
+
+// Keep DID documents in memory, mostly useful for testing.
+type memoryResolver struct {
+	docs map[string][]byte
+	mu   sync.RWMutex
+}
+
+func newMemoryResolver() *memoryResolver {
+	return &memoryResolver{
+		docs: make(map[string][]byte),
+	}
+}
+
+// Register a document for the identifier.
+func (r *memoryResolver) Add(id *did.Identifier, doc []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.docs[id.String()] = doc
+}
+
+// Load all the '*.json' DID documents available in a directory.
+func (r *memoryResolver) Load(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range files {
+		doc, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		entry := struct {
+			ID string `json:"id"`
+		}{}
+		if err = json.Unmarshal(doc, &entry); err != nil || entry.ID == "" {
+			return fmt.Errorf("invalid DID document: %s", f)
+		}
+		r.docs[entry.ID] = doc
+	}
+	return nil
+}
+
+func (r *memoryResolver) Resolve(id *did.Identifier) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	doc, ok := r.docs[id.String()]
+	if !ok {
+		return nil, fmt.Errorf("no document registered for %s", id.String())
+	}
+	return doc, nil
+}
+
+// File name used to store the document for the identifier.
+func documentFile(id *did.Identifier) string {
+	return fmt.Sprintf("%s.json", strings.Replace(id.Subject(), ":", "_", -1))
+}
+
+// Parameters to configure the DID resolver used by a command, all values
+// are stored under the '<prefix>.resolver' key.
+func resolverParams(prefix string) []cli.Param {
+	return []cli.Param{
+		{
+			Name:      "resolver",
+			Usage:     "resolver backend to use for 'did:bryk' identifiers (http, local or memory)",
+			FlagKey:   fmt.Sprintf("%s.resolver.backend", prefix),
+			ByDefault: "http",
+		},
+		{
+			Name:      "resolver-endpoint",
+			Usage:     "base URL for the 'http' DID resolver",
+			FlagKey:   fmt.Sprintf("%s.resolver.endpoint", prefix),
+			ByDefault: "https://did.bryk.io/v1/retrieve",
+		},
+		{
+			Name:      "resolver-path",
+			Usage:     "directory containing DID documents for the 'local' and 'memory' resolvers",
+			FlagKey:   fmt.Sprintf("%s.resolver.path", prefix),
+			ByDefault: "",
+		},
+	}
+}
+
+// Return a DID resolver supporting all the available DID methods. The
+// backend used for 'did:bryk' identifiers is selected based on the
+// configuration values available under the '<prefix>.resolver' key.
+func getResolver(prefix string) (Resolver, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	backend, err := getBackend(fmt.Sprintf("%s.resolver", prefix), client)
+	if err != nil {
+		return nil, err
+	}
+	rr := newResolverRegistry()
+	rr.Register("bryk", backend)
+	rr.Register("key", &keyResolver{})
+	rr.Register("web", &webResolver{client: client})
+	return rr, nil
+}
+
+func getBackend(key string, client *http.Client) (Resolver, error) {
+	switch viper.GetString(key + ".backend") {
+	case "http", "":
+		endpoint := viper.GetString(key + ".endpoint")
+		if endpoint == "" {
+			return nil, errors.New("an endpoint is required for the 'http' resolver")
+		}
+		return &httpResolver{
+			endpoint: endpoint,
+			client:   client,
+		}, nil
+	case "local":
+		dir := viper.GetString(key + ".path")
+		if dir == "" {
+			return nil, errors.New("a directory is required for the 'local' resolver")
+		}
+		return &localResolver{dir: dir}, nil
+	case "memory":
+		r := newMemoryResolver()
+		if dir := viper.GetString(key + ".path"); dir != "" {
+			if err := r.Load(dir); err != nil {
+				return nil, err
+			}
+		}
+		return r, nil
+	default:
+		return nil, fmt.Errorf("unknown DID resolver: %s", viper.GetString(key+".backend"))
+	}
+}
@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// Revocation reason codes, as defined in RFC 5280 section 5.3.1.
+var revocationReasons = map[string]int{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"caCompromise":         2,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+	"certificateHold":      6,
+	"privilegeWithdrawn":   9,
+	"aACompromise":         10,
+}
+
+var oidReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+// Entry of a legacy JSON revocation list. Either a single certificate,
+// identified by its serial number, or all the certificates issued for a
+// DID.
+type revocation struct {
+	Serial    string    `json:"serial,omitempty"`
+	DID       string    `json:"did,omitempty"`
+	Reason    int       `json:"reason"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// The registry is the single source of truth for the revocation status of
+// issued certificates. Entries in a legacy JSON revocation list are
+// imported into it when the server starts; returns the number of
+// certificates imported.
+func importRevocations(reg *certRegistry, path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var entries []*revocation
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return 0, fmt.Errorf("invalid revocation list '%s': %s", path, err)
+	}
+	count := 0
+	for _, e := range entries {
+		var serials []string
+		if e.Serial != "" {
+			serial, err := parseSerial(e.Serial)
+			if err != nil {
+				return count, err
+			}
+			serials = append(serials, formatSerial(serial))
+		} else if e.DID != "" {
+			list, err := reg.byDID(e.DID)
+			if err != nil {
+				return count, err
+			}
+			for _, rec := range list {
+				serials = append(serials, rec.Serial)
+			}
+		}
+		for _, serial := range serials {
+			rec, err := reg.get(serial)
+			if err != nil {
+				return count, err
+			}
+			if rec == nil || rec.Revoked {
+				continue
+			}
+			if err = reg.markRevoked(serial, e.Reason, e.RevokedAt.UTC()); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Generate a DER-encoded v2 CRL, signed by the CA, including the revoked
+// certificates it issued. CRL numbers are derived from the issuance time,
+// so they keep increasing across restarts without storing any state.
+func revocationCRL(ca *authority, reg *certRegistry, validity time.Duration) ([]byte, error) {
+	list, err := reg.list(func(rec *certRecord) bool { return rec.Revoked })
+	if err != nil {
+		return nil, err
+	}
+	var revoked []pkix.RevokedCertificate
+	for _, rec := range list {
+		cert, err := parseCertificate(rec.Cert)
+		if err != nil {
+			return nil, err
+		}
+		if !issuedBy(cert, ca.cert) {
+			continue
+		}
+		rc := pkix.RevokedCertificate{
+			SerialNumber:   cert.SerialNumber,
+			RevocationTime: rec.RevokedAt.UTC(),
+		}
+		if rec.Reason != 0 {
+			reason, err := asn1.Marshal(asn1.Enumerated(rec.Reason))
+			if err != nil {
+				return nil, err
+			}
+			rc.Extensions = []pkix.Extension{{Id: oidReasonCode, Value: reason}}
+		}
+		revoked = append(revoked, rc)
+	}
+	now := time.Now().UTC()
+	tpl := &x509.RevocationList{
+		Number:              big.NewInt(now.UnixNano()),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(validity),
+		RevokedCertificates: revoked,
+	}
+	return x509.CreateRevocationList(rand.Reader, tpl, ca.cert, ca.key)
+}
+
+// Check if the certificate names the CA as its issuer.
+func issuedBy(cert, ca *x509.Certificate) bool {
+	if !bytes.Equal(cert.RawIssuer, ca.RawSubject) {
+		return false
+	}
+	if len(cert.AuthorityKeyId) > 0 && len(ca.SubjectKeyId) > 0 {
+		return bytes.Equal(cert.AuthorityKeyId, ca.SubjectKeyId)
+	}
+	return true
+}
+
+// Serial numbers are stored as lowercase hex values.
+func formatSerial(serial *big.Int) string {
+	return serial.Text(16)
+}
+
+// Parse a hex-encoded serial number, optionally using ':' separators.
+func parseSerial(value string) (*big.Int, error) {
+	value = strings.ToLower(strings.Replace(value, ":", "", -1))
+	serial, ok := new(big.Int).SetString(value, 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid serial number: %s", value)
+	}
+	return serial, nil
+}
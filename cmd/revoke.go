@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bryk-io/x/cli"
+	"github.com/bryk-io/x/did"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var revokeCmd = &cobra.Command{
+	Use:     "revoke",
+	Short:   "Revoke a certificate by serial number, or all the certificates issued for a DID",
+	Example: "suss-workshop revoke 4d81bd522edb4703 --reason keyCompromise",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("you need to provide a certificate serial number or a DID")
+		}
+		reason, ok := revocationReasons[viper.GetString("revoke.reason")]
+		if !ok {
+			return fmt.Errorf("invalid reason, supported values: %s", strings.Join(reasonNames(), ", "))
+		}
+
+		// Select the certificates to revoke, when a DID is provided all
+		// its certificates that are not already revoked are included
+		reg, err := openRegistry(viper.GetString("ca.registry"))
+		if err != nil {
+			return err
+		}
+		var serials []string
+		if strings.HasPrefix(args[0], "did:") {
+			id, err := did.Parse(args[0])
+			if err != nil {
+				return err
+			}
+			list, err := reg.byDID(id.String())
+			if err != nil {
+				return err
+			}
+			for _, rec := range list {
+				if !rec.Revoked {
+					serials = append(serials, rec.Serial)
+				}
+			}
+			if len(serials) == 0 {
+				return errors.New("no active certificates found for the DID")
+			}
+		} else {
+			serial, err := parseSerial(args[0])
+			if err != nil {
+				return err
+			}
+			serials = append(serials, formatSerial(serial))
+		}
+
+		// The registry is the source of truth for revocation, both the CRL
+		// and the OCSP responses of a running server are derived from it
+		now := time.Now().UTC()
+		for _, serial := range serials {
+			if err = reg.markRevoked(serial, reason, now); err != nil {
+				return fmt.Errorf("%s: %s", serial, err)
+			}
+			fmt.Printf("certificate revoked: %s\n", serial)
+		}
+		return nil
+	},
+}
+
+func init() {
+	params := []cli.Param{
+		{
+			Name:      "reason",
+			Usage:     fmt.Sprintf("revocation reason (%s)", strings.Join(reasonNames(), ", ")),
+			FlagKey:   "revoke.reason",
+			ByDefault: "unspecified",
+		},
+	}
+	if err := cli.SetupCommandParams(revokeCmd, params); err != nil {
+		panic(err)
+	}
+	rootCmd.AddCommand(revokeCmd)
+}
+
+func reasonNames() []string {
+	var list []string
+	for k := range revocationReasons {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Return the name for a revocation reason code.
+func reasonName(code int) string {
+	for k, v := range revocationReasons {
+		if v == code {
+			return k
+		}
+	}
+	return fmt.Sprintf("unknown (%d)", code)
+}
@@ -24,10 +24,36 @@ func Execute() {
 }
 
 func init() {
-	// Add support for ECHO_ env variables
+	// Add support for SUSS_ env variables
 	cobra.OnInitialize(func() {
 		viper.SetEnvPrefix("suss")
-		viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+		viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
 		viper.AutomaticEnv()
 	})
+
+	// CA material locations, shared by all commands. Values can be file
+	// paths, like mounted secrets, or base64-encoded contents using the
+	// 'base64:' prefix. Keys can also be stored in a PKCS#11 token.
+	caParams := []struct {
+		name, key, value, usage string
+	}{
+		{"ca-config", "ca.config", "ca_conf.json", "CA configuration file"},
+		{"ca-root", "ca.root", "root-ca.crt", "root CA certificate"},
+		{"ca-root-key", "ca.root-key", "root-ca.pem", "root CA private key, use 'pkcs11:object=<label>' for keys stored in a PKCS#11 token"},
+		{"ca-registry", "ca.registry", "certs.db", "registry of issued certificates, the source of truth for revocation"},
+		{"ca-revocation-list", "ca.revocation-list", "revoked.json", "legacy list of revoked certificates, imported into the registry when the server starts"},
+		{"ca-trust-bundle", "ca.trust-bundle", "", "additional CA certificates trusted when verifying users, such as a previous root or partner CAs"},
+		{"ca-cert", "ca.cert", "", "signing CA certificate, the root CA is used if not provided"},
+		{"ca-key", "ca.key", "", "signing CA private key, required when 'ca-cert' is provided"},
+		{"ca-passphrase-file", "ca.passphrase-file", "", "file containing the passphrase for encrypted CA private keys, 'SUSS_CA_PASSPHRASE' can be used instead"},
+		{"ca-pkcs11-module", "ca.pkcs11.module", "", "PKCS#11 module used to access CA keys stored in a token"},
+		{"ca-pkcs11-slot", "ca.pkcs11.slot", "0", "PKCS#11 slot for the token holding the CA keys"},
+		{"ca-pkcs11-pin-file", "ca.pkcs11.pin-file", "", "file containing the token PIN, 'SUSS_CA_PKCS11_PIN' can be used instead"},
+	}
+	for _, p := range caParams {
+		rootCmd.PersistentFlags().String(p.name, p.value, p.usage)
+		if err := viper.BindPFlag(p.key, rootCmd.PersistentFlags().Lookup(p.name)); err != nil {
+			panic(err)
+		}
+	}
 }
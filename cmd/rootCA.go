@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"io/ioutil"
 
+	"github.com/bryk-io/x/cli"
 	"github.com/bryk-io/x/pki"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var rootCACmd = &cobra.Command{
@@ -21,14 +23,30 @@ var rootCACmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
+		out := viper.GetString("root-ca.output")
+
+		// Generate the key inside a PKCS#11 token
+		if label, ok := pkcs11Label(viper.GetString("ca.root-key")); ok {
+			return rootCAWithToken(csrJSON, label, out)
+		}
+
 		cert, key, err := pki.RootCA(csrJSON)
 		if err != nil {
 			return err
 		}
-		if err = ioutil.WriteFile("root-ca.crt", cert, 0400); err != nil {
+		if viper.GetBool("root-ca.encrypt") {
+			signer, err := parsePrivateKey(key)
+			if err != nil {
+				return err
+			}
+			if key, err = encodeCAKey(signer, true); err != nil {
+				return err
+			}
+		}
+		if err = writeOutput(out, "root-ca.crt", cert); err != nil {
 			return err
 		}
-		if err = ioutil.WriteFile("root-ca.pem", key, 0400); err != nil {
+		if err = writeOutput(out, "root-ca.pem", key); err != nil {
 			return err
 		}
 		fmt.Println("root-ca created")
@@ -37,5 +55,51 @@ var rootCACmd = &cobra.Command{
 }
 
 func init() {
+	params := []cli.Param{
+		{
+			Name:      "encrypt",
+			Usage:     "encrypt the CA private key with a passphrase",
+			FlagKey:   "root-ca.encrypt",
+			ByDefault: false,
+		},
+		{
+			Name:      "output",
+			Usage:     "directory to store the generated CA certificate and private key",
+			FlagKey:   "root-ca.output",
+			ByDefault: ".",
+		},
+	}
+	if err := cli.SetupCommandParams(rootCACmd, params); err != nil {
+		panic(err)
+	}
 	rootCmd.AddCommand(rootCACmd)
 }
+
+// Create the root CA certificate for a new key generated in the PKCS#11
+// token, using the 'root' signing profile.
+func rootCAWithToken(csrJSON []byte, label, out string) error {
+	req, err := decodeCSRRequest(csrJSON)
+	if err != nil {
+		return err
+	}
+	if req.Key == nil {
+		req.Key = &csrKey{Algo: "ecdsa", Size: 256}
+	}
+	conf, err := readCAConfig()
+	if err != nil {
+		return err
+	}
+	key, err := generatePKCS11Key(label, req.Key)
+	if err != nil {
+		return err
+	}
+	cert, err := selfSignCA(conf, req, key, "root")
+	if err != nil {
+		return err
+	}
+	if err = writeOutput(out, "root-ca.crt", cert); err != nil {
+		return err
+	}
+	fmt.Printf("root-ca created, the private key is stored in the token as '%s'\n", label)
+	return nil
+}
@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/bryk-io/x/cli"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var rotateCACmd = &cobra.Command{
+	Use:   "rotate-ca",
+	Short: "Create a new root certificate authority, cross-signed by the current one",
+	Long: `Create a new root certificate authority, cross-signed by the current one
+
+The following files are produced:
+- new-root-ca.crt/new-root-ca.pem: certificate and private key for the new root
+- root-ca-cross.crt: the new root certificate issued by the current root
+- trust-bundle.crt: both root certificates
+
+To complete the rotation, use the new root as 'ca-root' and the trust bundle
+as 'ca-trust-bundle', so certificates issued by the current root are still
+accepted during the transition period. Intermediate CAs issued by the new
+root can include the cross-signed certificate after their own, so users
+trusting only the current root are able to validate them.`,
+	Example: "suss-workshop rotate-ca ca_csr.json",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("you need to provide the CSR json file")
+		}
+		csrJSON, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		req, err := decodeCSRRequest(csrJSON)
+		if err != nil {
+			return err
+		}
+		if req.Key == nil {
+			req.Key = &csrKey{Algo: "ecdsa", Size: 256}
+		}
+
+		// Current root
+		current, err := getRootCA()
+		if err != nil {
+			return err
+		}
+
+		// New root key, optionally generated inside a PKCS#11 token
+		var (
+			key    crypto.Signer
+			keyPEM []byte
+		)
+		label, inToken := pkcs11Label(viper.GetString("rotate-ca.key"))
+		if inToken {
+			key, err = generatePKCS11Key(label, req.Key)
+		} else {
+			key, err = generateKey(req.Key)
+		}
+		if err != nil {
+			return err
+		}
+		if !inToken {
+			if keyPEM, err = encodeCAKey(key, viper.GetBool("rotate-ca.encrypt")); err != nil {
+				return err
+			}
+		}
+
+		// New root and cross-signed certificates
+		profile := viper.GetString("rotate-ca.profile")
+		rootPEM, err := selfSignCA(current.conf, req, key, profile)
+		if err != nil {
+			return err
+		}
+		root, err := parseCertificate(rootPEM)
+		if err != nil {
+			return err
+		}
+		cross, err := current.crossSign(root, profile)
+		if err != nil {
+			return err
+		}
+		bundle := pemCertificate(current.root)
+		bundle = append(bundle, rootPEM...)
+
+		// Save results
+		out := viper.GetString("rotate-ca.output")
+		if err = writeOutput(out, "new-root-ca.crt", rootPEM); err != nil {
+			return err
+		}
+		if keyPEM != nil {
+			if err = writeOutput(out, "new-root-ca.pem", keyPEM); err != nil {
+				return err
+			}
+		}
+		if err = writeOutput(out, "root-ca-cross.crt", cross); err != nil {
+			return err
+		}
+		if err = writeOutput(out, "trust-bundle.crt", bundle); err != nil {
+			return err
+		}
+		fmt.Println("new root-ca created and cross-signed by the current one")
+		if inToken {
+			fmt.Printf("the private key is stored in the token as '%s'\n", label)
+		}
+		return nil
+	},
+}
+
+func init() {
+	params := []cli.Param{
+		{
+			Name:      "key",
+			Usage:     "generate the new private key inside a PKCS#11 token, using 'pkcs11:object=<label>'",
+			FlagKey:   "rotate-ca.key",
+			ByDefault: "",
+		},
+		{
+			Name:      "encrypt",
+			Usage:     "encrypt the new CA private key with a passphrase",
+			FlagKey:   "rotate-ca.encrypt",
+			ByDefault: false,
+		},
+		{
+			Name:      "profile",
+			Usage:     "signing profile to use for the new root and cross-signed certificates",
+			FlagKey:   "rotate-ca.profile",
+			ByDefault: "root",
+		},
+		{
+			Name:      "output",
+			Usage:     "directory to store the generated certificates and private key",
+			FlagKey:   "rotate-ca.output",
+			ByDefault: ".",
+		},
+	}
+	if err := cli.SetupCommandParams(rotateCACmd, params); err != nil {
+		panic(err)
+	}
+	rootCmd.AddCommand(rotateCACmd)
+}
@@ -1,20 +1,26 @@
 package cmd
 
 import (
-	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/aidtechnology/suss-workshop/cmd/chat"
-	"github.com/bryk-io/x/pki"
+	"github.com/bryk-io/x/cli"
+	"github.com/bryk-io/x/did"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var serverCmd = &cobra.Command{
@@ -26,6 +32,7 @@ var serverCmd = &cobra.Command{
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{chat.Protocol},
 	CheckOrigin: func(*http.Request) bool {
 		return true
 	},
@@ -42,58 +49,391 @@ func (sr *serviceResponse) encode() []byte {
 }
 
 func init() {
+	params := []cli.Param{
+		{
+			Name:      "challenge-ttl",
+			Usage:     "validity period for the enrollment challenges issued by the server",
+			FlagKey:   "server.challenge-ttl",
+			ByDefault: "5m",
+		},
+		{
+			Name:      "challenge-limit",
+			Usage:     "maximum number of outstanding enrollment challenges, new requests are rejected once reached",
+			FlagKey:   "server.challenge-limit",
+			ByDefault: 10000,
+		},
+		{
+			Name:      "port",
+			Usage:     "TCP port to use for the service",
+			FlagKey:   "server.port",
+			ByDefault: 9090,
+		},
+		{
+			Name:      "public-port",
+			Usage:     "TCP port for the enrollment endpoints when TLS is enabled",
+			FlagKey:   "server.public-port",
+			ByDefault: 9091,
+		},
+		{
+			Name:      "tls-cert",
+			Usage:     "server TLS certificate, enables mutual TLS authentication for users",
+			FlagKey:   "server.tls.cert",
+			ByDefault: "",
+		},
+		{
+			Name:      "tls-key",
+			Usage:     "private key for the server TLS certificate",
+			FlagKey:   "server.tls.key",
+			ByDefault: "",
+		},
+		{
+			Name:      "crl-validity",
+			Usage:     "validity period for the CRLs generated by the server",
+			FlagKey:   "server.crl-validity",
+			ByDefault: "24h",
+		},
+		{
+			Name:      "ocsp-cert",
+			Usage:     "delegated OCSP responder certificate, by default responses are signed by the CA",
+			FlagKey:   "server.ocsp.cert",
+			ByDefault: "",
+		},
+		{
+			Name:      "ocsp-key",
+			Usage:     "private key for the delegated OCSP responder certificate",
+			FlagKey:   "server.ocsp.key",
+			ByDefault: "",
+		},
+		{
+			Name:      "ocsp-validity",
+			Usage:     "validity period for the OCSP responses generated by the server",
+			FlagKey:   "server.ocsp.validity",
+			ByDefault: "1h",
+		},
+		{
+			Name:      "single-cert",
+			Usage:     "reject enrollment requests while the DID already holds a valid certificate",
+			FlagKey:   "server.single-cert",
+			ByDefault: false,
+		},
+		{
+			Name:      "profile",
+			Usage:     "signing profile to use for user certificates",
+			FlagKey:   "server.profile",
+			ByDefault: "user",
+		},
+		{
+			Name:      "renew-window",
+			Usage:     "period before expiration in which certificates can be renewed",
+			FlagKey:   "server.renew-window",
+			ByDefault: "168h",
+		},
+		{
+			Name:      "cert-header",
+			Usage:     "accept user certificates in the 'X-user-certificate' header, use ONLY behind an ingress that verifies them",
+			FlagKey:   "server.cert-header",
+			ByDefault: false,
+		},
+		{
+			Name:      "rooms",
+			Usage:     "predefined chat rooms, as a comma-separated list; users join the first one on connect",
+			FlagKey:   "server.rooms",
+			ByDefault: "lobby",
+		},
+		{
+			Name:      "create-rooms",
+			Usage:     "allow users to create chat rooms on demand",
+			FlagKey:   "server.create-rooms",
+			ByDefault: true,
+		},
+	}
+	params = append(params, resolverParams("server")...)
+	if err := cli.SetupCommandParams(serverCmd, params); err != nil {
+		panic(err)
+	}
 	rootCmd.AddCommand(serverCmd)
 }
 
 func runServer(_ *cobra.Command, _ []string) error {
+	// Validate authentication settings
+	tlsCert := viper.GetString("server.tls.cert")
+	tlsKey := viper.GetString("server.tls.key")
+	certHeader := viper.GetBool("server.cert-header")
+	if (tlsCert == "") != (tlsKey == "") {
+		return errors.New("both a TLS certificate and private key are required")
+	}
+	if tlsCert == "" && !certHeader {
+		return errors.New("user certificates can't be verified, enable TLS or use 'cert-header' behind a TLS-terminating ingress")
+	}
+
 	// Get server's certificate authority
 	ca, err := getCA()
 	if err != nil {
 		return err
 	}
+	profile := viper.GetString("server.profile")
+	sp, err := ca.profile(profile)
+	if err != nil {
+		return err
+	}
+
+	if !sp.allowsExtension(oidDIDIdentity) {
+		return fmt.Errorf("the '%s' profile must allow the DID identity extension (%s)", profile, oidDIDIdentity)
+	}
+
+	// Validate subject templates
+	if _, err = sp.subjectTemplate(); err != nil {
+		return fmt.Errorf("invalid subject template for profile '%s': %s", profile, err)
+	}
+	for name, p := range ca.conf.Signing.Profiles {
+		if p.SubjectTemplate == "" {
+			continue
+		}
+		if _, err = p.subjectTemplate(); err != nil {
+			return fmt.Errorf("invalid subject template for profile '%s': %s", name, err)
+		}
+	}
+
+	// DID resolver
+	resolver, err := getResolver("server")
+	if err != nil {
+		return err
+	}
+
+	// Enrollment challenges
+	ttl := viper.GetDuration("server.challenge-ttl")
+	if ttl <= 0 {
+		return errors.New("invalid challenge TTL value")
+	}
+	challengeLimit := viper.GetInt("server.challenge-limit")
+	if challengeLimit <= 0 {
+		return errors.New("invalid challenge limit value")
+	}
+	challenges := newChallengeStore(ttl, challengeLimit)
+	go challenges.cleanup(time.Minute)
+
+	// Issued certificates
+	registry, err := openRegistry(viper.GetString("ca.registry"))
+	if err != nil {
+		return err
+	}
+	backfilled, err := registry.backfillLog()
+	if err != nil {
+		return err
+	}
+	if backfilled > 0 {
+		log.Printf("added %d previously issued certificates to the transparency log", backfilled)
+	}
+
+	// Revoked certificates, entries in a legacy revocation list are moved
+	// to the registry
+	imported, err := importRevocations(registry, viper.GetString("ca.revocation-list"))
+	if err != nil {
+		return err
+	}
+	if imported > 0 {
+		log.Printf("imported %d revoked certificates into the registry", imported)
+	}
+	crlValidity := viper.GetDuration("server.crl-validity")
+	if crlValidity <= 0 {
+		return errors.New("invalid CRL validity value")
+	}
+
+	// Renewal window
+	renewWindow := viper.GetDuration("server.renew-window")
+	if renewWindow <= 0 {
+		return errors.New("invalid renewal window value")
+	}
+
+	// OCSP responder
+	ocspValidity := viper.GetDuration("server.ocsp.validity")
+	if ocspValidity <= 0 {
+		return errors.New("invalid OCSP validity value")
+	}
+	ocspCert := viper.GetString("server.ocsp.cert")
+	ocspKey := viper.GetString("server.ocsp.key")
+	if (ocspCert == "") != (ocspKey == "") {
+		return errors.New("both a certificate and private key are required for the OCSP responder")
+	}
+	responder, err := newOCSPResponder(ca, registry, ocspCert, ocspKey, ocspValidity)
+	if err != nil {
+		return err
+	}
 
 	// Users hub
-	hub := chat.NewHub()
+	hub, err := chat.NewHub(strings.Split(viper.GetString("server.rooms"), ","), viper.GetBool("server.create-rooms"))
+	if err != nil {
+		return err
+	}
+	hub.Directory = func(id string) bool {
+		ok, err := registry.hasValid(id)
+		if err != nil {
+			log.Printf("failed to look up %s in the registry: %s", id, err)
+		}
+		return ok
+	}
 	go hub.Run()
 
-	// Setup server's router
+	// Setup server's routers. When TLS is enabled every connection to the
+	// main port must present a valid client certificate, so the enrollment
+	// endpoints are exposed on a separate public port
 	router := mux.NewRouter()
-	router.HandleFunc("/enroll", enrollHandler(ca)).Methods(http.MethodPost)
-	router.HandleFunc("/connect", connectHandler(ca, hub)).Methods(http.MethodGet)
-	router.PathPrefix("/").HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
-		res.Header().Set("Content-Type", "application/json")
-		res.WriteHeader(200)
-		r := &serviceResponse{
-			Ok: true,
-			Response: "SUSS workshop sample service =D",
-		}
-		res.Write(r.encode())
-	})
+	public := router
+	if tlsCert != "" {
+		public = mux.NewRouter()
+	}
+	public.SkipClean(true) // OCSP GET requests may include '//' sequences
+	public.HandleFunc("/challenge", challengeHandler(ca, challenges, profile)).Methods(http.MethodGet)
+	singleCert := viper.GetBool("server.single-cert")
+	public.HandleFunc("/enroll", enrollHandler(ca, challenges, resolver, registry, profile, singleCert)).Methods(http.MethodPost)
+	public.HandleFunc("/crl", crlHandler(ca, registry, crlValidity)).Methods(http.MethodGet)
+	public.Handle("/ocsp", responder).Methods(http.MethodPost)
+	public.PathPrefix("/ocsp/").Handler(responder).Methods(http.MethodGet)
+	public.HandleFunc("/log/head", logHeadHandler(ca, registry)).Methods(http.MethodGet)
+	public.HandleFunc("/log/proof/inclusion", logInclusionHandler(registry)).Methods(http.MethodGet)
+	public.HandleFunc("/log/proof/consistency", logConsistencyHandler(registry)).Methods(http.MethodGet)
+	router.HandleFunc("/connect", connectHandler(ca, hub, registry, profile, certHeader)).Methods(http.MethodGet)
+	router.HandleFunc("/renew", renewHandler(ca, registry, resolver, profile, certHeader, renewWindow)).Methods(http.MethodPost)
+	router.PathPrefix("/").HandlerFunc(indexHandler)
+	if public != router {
+		public.PathPrefix("/").HandlerFunc(indexHandler)
+	}
 
 	// Start server
+	port := viper.GetInt("server.port")
 	srv := &http.Server{
 		Handler:      router,
-		Addr:         ":9090",
+		Addr:         fmt.Sprintf(":%d", port),
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
+	if tlsCert == "" {
+		fmt.Println("server ready")
+		fmt.Printf("waiting for connections at port: %d\n", port)
+		return srv.ListenAndServe()
+	}
+
+	// Require users to authenticate with a certificate issued by the CA
+	srv.TLSConfig = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  ca.roots(),
+		MinVersion: tls.VersionTLS12,
+	}
+	publicPort := viper.GetInt("server.public-port")
+	publicSrv := &http.Server{
+		Handler:      public,
+		Addr:         fmt.Sprintf(":%d", publicPort),
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+	errCh := make(chan error)
+	go func() {
+		errCh <- srv.ListenAndServeTLS(tlsCert, tlsKey)
+	}()
+	go func() {
+		errCh <- publicSrv.ListenAndServeTLS(tlsCert, tlsKey)
+	}()
 	fmt.Println("server ready")
-	fmt.Println("waiting for connections at port: 9090")
-	return srv.ListenAndServe()
+	fmt.Printf("waiting for connections at port: %d (mutual TLS)\n", port)
+	fmt.Printf("enrollment available at port: %d\n", publicPort)
+	return <-errCh
+}
+
+// Index
+// Basic service information.
+func indexHandler(res http.ResponseWriter, _ *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	r := &serviceResponse{
+		Ok:       true,
+		Response: "SUSS workshop sample service =D",
+	}
+	res.Write(r.encode())
+}
+
+// Challenge
+// Issue a random single-use challenge for the DID provided in the 'did'
+// query parameter. The challenge must be signed by one of the DID's keys
+// and submitted with the enrollment request before it expires. Requesting
+// a new challenge replaces the oldest one outstanding for the DID, and
+// requests are rejected while the store is full.
+func challengeHandler(ca *authority, cs *challengeStore, profile string) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		r := &serviceResponse{
+			Ok:       false,
+			Response: "",
+		}
+
+		// Validate provided DID
+		id, err := did.Parse(req.URL.Query().Get("did"))
+		if err != nil {
+			res.WriteHeader(400)
+			r.Response = "invalid DID value"
+			res.Write(r.encode())
+			return
+		}
+
+		// Issue challenge, advertising the key specification required
+		// for the certificate request
+		p, err := ca.profile(profile)
+		if err != nil {
+			res.WriteHeader(500)
+			r.Response = err.Error()
+			res.Write(r.encode())
+			return
+		}
+		key, err := p.keySpec()
+		if err != nil {
+			res.WriteHeader(500)
+			r.Response = err.Error()
+			res.Write(r.encode())
+			return
+		}
+		c, err := cs.issue(id.String())
+		if err == errTooManyChallenges {
+			res.WriteHeader(http.StatusTooManyRequests)
+			r.Response = err.Error()
+			res.Write(r.encode())
+			return
+		}
+		if err != nil {
+			res.WriteHeader(500)
+			r.Response = "failed to generate challenge"
+			res.Write(r.encode())
+			return
+		}
+		issued := *c
+		issued.Key = key
+		r.Ok = true
+		r.Response = &issued
+		res.Write(r.encode())
+	}
 }
 
 // Enroll
 // The server will generate a client certificate for the user.
 // Enrollment requests include the following fields:
 // - did: subject's DID to use
-// - challenge: a random value generated to authorize the transaction
+// - challenge: a value previously issued by the server's '/challenge' endpoint
 // - signature: signature generated for the challenge
+// - csr: PKCS#10 certificate request signed by the user's private key
+// - metadata: optional key/value pairs made available to the subject template
 //
 // To process the enrollment the server performs the following:
+// - Validate the metadata provided
+// - Redeem the challenge, it must be issued for the DID, not expired and unused
 // - Resolve the DID
 // - Verify the signature/challenge is valid
-// - Generate a certificate and private key for the DID
-func enrollHandler(ca *pki.CA) http.HandlerFunc {
+// - Verify the CSR signature as proof of possession of the private key
+// - When 'singleCert' is enabled, verify the DID doesn't hold a valid certificate
+// - Generate a certificate for the DID and record it in the registry, the
+//   private key never leaves the user
+// - Return the certificate along with the CA chain
+func enrollHandler(ca *authority, cs *challengeStore, resolver Resolver, reg *certRegistry, profile string, singleCert bool) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Content-Type", "application/json")
 		r := &serviceResponse{
@@ -119,9 +459,30 @@ func enrollHandler(ca *pki.CA) http.HandlerFunc {
 			res.Write(r.encode())
 			return
 		}
+		if err = validateMetadata(er.Metadata); err != nil {
+			res.WriteHeader(400)
+			r.Response = err.Error()
+			res.Write(r.encode())
+			return
+		}
+
+		// Redeem challenge
+		d, err := did.Parse(er.Did)
+		if err != nil {
+			res.WriteHeader(400)
+			r.Response = "invalid DID value"
+			res.Write(r.encode())
+			return
+		}
+		if err = cs.redeem(d.String(), er.Challenge); err != nil {
+			res.WriteHeader(400)
+			r.Response = err.Error()
+			res.Write(r.encode())
+			return
+		}
 
 		// Resolve provided DID
-		id, err := resolveDID(er.Did)
+		id, doc, err := resolveDocument(resolver, er.Did)
 		if err != nil {
 			res.WriteHeader(400)
 			r.Response = "failed to resolve DID"
@@ -130,25 +491,49 @@ func enrollHandler(ca *pki.CA) http.HandlerFunc {
 		}
 
 		// Validate challenge/signature
-		if err = verifySignature(id, er.Challenge, er.Signature); err != nil {
+		if err = verifySignature(id, doc, er.Challenge, er.Signature); err != nil {
 			res.WriteHeader(400)
 			r.Response = err.Error()
 			res.Write(r.encode())
 			return
 		}
 
-		// Generate CSR
-		buf := bytes.NewBuffer(nil)
-		if err = tplUserCSR.Execute(buf, map[string]string{"DID":id.String()}); err != nil {
+		// Enforce a single valid certificate per DID
+		if singleCert {
+			active, err := reg.hasValid(id.String())
+			if err != nil {
+				log.Println(err.Error())
+				res.WriteHeader(500)
+				r.Response = "failed to verify existing certificates"
+				res.Write(r.encode())
+				return
+			}
+			if active {
+				res.WriteHeader(409)
+				r.Response = "the DID already holds a valid certificate"
+				res.Write(r.encode())
+				return
+			}
+		}
+
+		// Validate certificate request
+		csr, err := parseCSR(er.CSR)
+		if err != nil {
 			res.WriteHeader(400)
-			r.Response = "failed to generate CSR"
+			r.Response = err.Error()
 			res.Write(r.encode())
 			return
 		}
 
 		// Generate certificate
-		cert, key, err := ca.SignRequestJSON(buf.Bytes(), "user")
+		subject := &subjectData{
+			DID:      id.String(),
+			Document: doc,
+			Metadata: er.Metadata,
+		}
+		cert, err := issueCertificate(ca, reg, csr, subject, profile, sourceEnroll)
 		if err != nil {
+			log.Println(err.Error())
 			res.WriteHeader(400)
 			r.Response = "failed to generate certificate"
 			res.Write(r.encode())
@@ -159,53 +544,301 @@ func enrollHandler(ca *pki.CA) http.HandlerFunc {
 		r.Ok = true
 		r.Response = &enrollmentResponse{
 			Cert: cert,
-			Key:  key,
 		}
 		res.Write(r.encode())
 		return
 	}
 }
 
+// Renew
+// Issue a replacement certificate for the same DID. Renewal requests are
+// authenticated with the current certificate, which must still be valid,
+// recorded in the registry and expire within the renewal window. Requests include the following fields:
+// - csr: PKCS#10 certificate request for the new key
+// - signature: signature for the CSR produced with the current certificate's key
+// The DID is resolved again and the metadata provided on enrollment reused,
+// so the subject reflects the current contents of the DID document.
+func renewHandler(ca *authority, reg *certRegistry, resolver Resolver, profile string, certHeader bool, window time.Duration) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		r := &serviceResponse{
+			Ok:       false,
+			Response: "",
+		}
+
+		// Validate current certificate
+		current, err := clientCertificate(req, certHeader)
+		if err != nil {
+			res.WriteHeader(http.StatusUnauthorized)
+			r.Response = "a valid certificate is required"
+			res.Write(r.encode())
+			return
+		}
+		cert, err := ca.verifyCertificate(current, profile)
+		if err != nil {
+			res.WriteHeader(http.StatusUnauthorized)
+			r.Response = "a valid certificate is required"
+			res.Write(r.encode())
+			return
+		}
+
+		// Certificates issued by CAs in the trust bundle are accepted to
+		// connect, but only certificates issued by the service are renewed
+		rec, err := reg.get(formatSerial(cert.SerialNumber))
+		if err != nil {
+			log.Println(err.Error())
+			res.WriteHeader(http.StatusInternalServerError)
+			r.Response = "failed to check the certificate status"
+			res.Write(r.encode())
+			return
+		}
+		if !issuedByService(rec, cert) {
+			res.WriteHeader(http.StatusForbidden)
+			r.Response = "the certificate was not issued by this service"
+			res.Write(r.encode())
+			return
+		}
+		if rec.Revoked {
+			res.WriteHeader(http.StatusForbidden)
+			r.Response = "the certificate has been revoked"
+			res.Write(r.encode())
+			return
+		}
+		if time.Until(cert.NotAfter) > window {
+			res.WriteHeader(400)
+			r.Response = fmt.Sprintf("renewal is only available %s before expiration", window)
+			res.Write(r.encode())
+			return
+		}
+
+		// Decode renewal request
+		defer req.Body.Close()
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil || len(body) == 0 {
+			res.WriteHeader(400)
+			r.Response = "empty request"
+			res.Write(r.encode())
+			return
+		}
+		rr := &renewalRequest{}
+		if err = json.Unmarshal(body, rr); err != nil {
+			res.WriteHeader(400)
+			r.Response = "invalid request contents"
+			res.Write(r.encode())
+			return
+		}
+
+		// Verify possession of both the current and new keys
+		csr, err := parseCSR(rr.CSR)
+		if err != nil {
+			res.WriteHeader(400)
+			r.Response = err.Error()
+			res.Write(r.encode())
+			return
+		}
+		if err = verifyKeySignature(cert.PublicKey, renewalDigest(csr.Raw), rr.Signature); err != nil {
+			res.WriteHeader(http.StatusUnauthorized)
+			r.Response = "invalid renewal signature"
+			res.Write(r.encode())
+			return
+		}
+
+		// Generate replacement certificate
+		id, doc, err := resolveDocument(resolver, certificateDID(cert))
+		if err != nil {
+			res.WriteHeader(400)
+			r.Response = "failed to resolve DID"
+			res.Write(r.encode())
+			return
+		}
+		subject := &subjectData{
+			DID:      id.String(),
+			Document: doc,
+			Metadata: rec.Metadata,
+		}
+		renewed, err := issueCertificate(ca, reg, csr, subject, profile, sourceRenew)
+		if err != nil {
+			log.Println(err.Error())
+			res.WriteHeader(400)
+			r.Response = "failed to generate certificate"
+			res.Write(r.encode())
+			return
+		}
+		r.Ok = true
+		r.Response = &enrollmentResponse{
+			Cert: renewed,
+		}
+		res.Write(r.encode())
+	}
+}
+
+// Issue a certificate for the DID using the signing profile and record it
+// in the registry. Returns the PEM-encoded certificate followed by the CA
+// chain.
+func issueCertificate(ca *authority, reg *certRegistry, csr *x509.CertificateRequest, data *subjectData, profile, source string) ([]byte, error) {
+	// Generate certificate subject
+	p, err := ca.profile(profile)
+	if err != nil {
+		return nil, err
+	}
+	st, err := p.subjectTemplate()
+	if err != nil {
+		return nil, err
+	}
+	tpl, err := renderSubject(st, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// The DID is always included as URI SAN, along with the identity extension
+	tpl.URIs = append(tpl.URIs, data.DID)
+	ext, err := didExtension(data.DID, data.Document)
+	if err != nil {
+		return nil, err
+	}
+
+	// Generate certificate
+	cert, err := ca.signCSR(csr, tpl, profile, ext)
+	if err != nil {
+		return nil, err
+	}
+
+	// Register certificate
+	issued, err := parseCertificate(cert)
+	if err != nil {
+		return nil, err
+	}
+	if err = reg.record(issued, cert, profile, source, data.Metadata); err != nil {
+		return nil, err
+	}
+	return ca.bundle(cert), nil
+}
+
+// CRL
+// Return the current DER-encoded certificate revocation list, signed by the CA.
+func crlHandler(ca *authority, reg *certRegistry, validity time.Duration) http.HandlerFunc {
+	return func(res http.ResponseWriter, _ *http.Request) {
+		crl, err := revocationCRL(ca, reg, validity)
+		if err != nil {
+			log.Println(err.Error())
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		res.Header().Set("Content-Type", "application/pkix-crl")
+		res.Write(crl)
+	}
+}
+
 // Connect
 // Receive a user request to start a session with the service.
 // The server will validate the client certificate to prevent unauthorized access.
-func connectHandler(ca *pki.CA, hub *chat.Hub) http.HandlerFunc {
+// The certificate is obtained from the TLS connection or, only when 'certHeader'
+// is enabled, from the 'X-user-certificate' header. Revoked certificates are
+// rejected before upgrading the connection. The client must also sign a server
+// nonce with the certificate's key before joining the hub.
+func connectHandler(ca *authority, hub *chat.Hub, reg *certRegistry, profile string, certHeader bool) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
-		// Verify header is present
-		if req.Header.Get("X-user-certificate") == "" {
-			log.Println("missing user certificate")
+		// Retrieve user certificate
+		cert, err := clientCertificate(req, certHeader)
+		if err != nil {
+			log.Println(err.Error())
+			res.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		// Decode header
-		cert, err := base64.StdEncoding.DecodeString(req.Header.Get("X-user-certificate"))
+		// Validate certificate
+		userCert, err := ca.verifyCertificate(cert, profile)
 		if err != nil {
-			log.Println("failed to decode provided certificate")
+			log.Println(err.Error())
+			res.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		// Validate certificate
-		if err = ca.VerifyCertificate(cert, &pki.VerifyOptions{ProfileName: "user"}); err != nil {
+		// Check revocation status
+		revoked, err := reg.isRevoked(userCert)
+		if err != nil {
 			log.Println(err.Error())
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if revoked {
+			log.Printf("revoked certificate: %s", formatSerial(userCert.SerialNumber))
+			res.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		// Authenticated identity
+		id := chatIdentity(userCert)
+		if id.DID == "" {
+			log.Printf("certificate without DID: %s", formatSerial(userCert.SerialNumber))
+			res.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
 		// Establish socket connection
-		serveWS(hub, res, req)
+		serveWS(hub, userCert, id, res, req)
 	}
 }
 
+// Return the identity for a user authenticated with the certificate. The
+// common name is used as display name when it's not the DID itself.
+func chatIdentity(cert *x509.Certificate) chat.Identity {
+	id := chat.Identity{DID: certificateDID(cert)}
+	if cn := cert.Subject.CommonName; cn != id.DID && !strings.HasPrefix(cn, "did:") {
+		id.Name = cn
+	}
+	return id
+}
+
+// Return the PEM-encoded certificate presented by the client, followed by
+// any intermediates it included.
+func clientCertificate(req *http.Request, certHeader bool) ([]byte, error) {
+	// Certificate chain verified during the TLS handshake
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		var chain []byte
+		for _, c := range req.TLS.PeerCertificates {
+			chain = append(chain, pemCertificate(c)...)
+		}
+		return chain, nil
+	}
+	if !certHeader {
+		return nil, errors.New("missing user certificate")
+	}
+
+	// Certificate forwarded by the ingress, either base64 or URL encoded
+	value := req.Header.Get("X-user-certificate")
+	if value == "" {
+		return nil, errors.New("missing user certificate")
+	}
+	if cert, err := url.QueryUnescape(value); err == nil && strings.HasPrefix(cert, "-----BEGIN") {
+		return []byte(cert), nil
+	}
+	cert, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.New("failed to decode provided certificate")
+	}
+	return cert, nil
+}
+
 // Handles websocket requests
-func serveWS(hub *chat.Hub, w http.ResponseWriter, r *http.Request) {
+// Before registering the client in the hub it must prove possession
+// of the private key for the certificate used to authenticate.
+func serveWS(hub *chat.Hub, cert *x509.Certificate, id chat.Identity, w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	if err = requestProof(conn, cert, r.Host, r.TLS); err != nil {
+		log.Printf("handshake failed for %s: %s", id.DID, err)
+		conn.Close()
+		return
+	}
 	client := &chat.Client{
-		Hub:  hub,
-		Conn: conn,
-		Send: make(chan []byte, 256),
+		Hub:      hub,
+		Conn:     conn,
+		Send:     make(chan *chat.Message, 256),
+		Identity: id,
 	}
 	client.Hub.Register <- client
 
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/bryk-io/x/cli"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ocsp"
+)
+
+var statusCmd = &cobra.Command{
+	Use:     "status",
+	Short:   "Query the revocation status of a certificate using OCSP",
+	Example: "suss-workshop status user.crt",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("you need to provide the certificate file")
+		}
+
+		// Load certificate and issuer. If the certificate file includes
+		// its chain, the issuer is the next certificate on it
+		certPEM, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		certs, err := parseCertificates(certPEM)
+		if err != nil {
+			return err
+		}
+		cert := certs[0]
+		if len(certs) == 1 {
+			caPEM, err := ioutil.ReadFile(viper.GetString("status.ca"))
+			if err != nil {
+				return err
+			}
+			ca, err := parseCertificate(caPEM)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, ca)
+		}
+		issuer := certs[1]
+
+		// Responder location
+		responder := viper.GetString("status.responder")
+		if responder == "" {
+			if len(cert.OCSPServer) == 0 {
+				return errors.New("the certificate doesn't include an OCSP responder location")
+			}
+			responder = cert.OCSPServer[0]
+		}
+
+		// Submit request
+		req, err := ocsp.CreateRequest(cert, issuer, &ocsp.RequestOptions{Hash: crypto.SHA1})
+		if err != nil {
+			return err
+		}
+		client := &http.Client{Timeout: 10 * time.Second}
+		res, err := client.Post(responder, "application/ocsp-request", bytes.NewReader(req))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+
+		// Verify and display response
+		resp, err := ocsp.ParseResponseForCert(body, cert, issuer)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("serial:      %s\n", formatSerial(cert.SerialNumber))
+		fmt.Printf("subject:     %s\n", cert.Subject.CommonName)
+		fmt.Printf("did:         %s\n", certificateDID(cert))
+		switch resp.Status {
+		case ocsp.Good:
+			fmt.Println("status:      good")
+		case ocsp.Revoked:
+			fmt.Println("status:      revoked")
+			fmt.Printf("revoked at:  %s\n", resp.RevokedAt.Local().Format(time.RFC822))
+			fmt.Printf("reason:      %s\n", reasonName(resp.RevocationReason))
+		default:
+			fmt.Println("status:      unknown")
+		}
+		fmt.Printf("this update: %s\n", resp.ThisUpdate.Local().Format(time.RFC822))
+		if !resp.NextUpdate.IsZero() {
+			fmt.Printf("next update: %s\n", resp.NextUpdate.Local().Format(time.RFC822))
+		}
+		return nil
+	},
+}
+
+func init() {
+	params := []cli.Param{
+		{
+			Name:      "ca",
+			Usage:     "certificate of the issuing CA, when not included in the certificate file",
+			FlagKey:   "status.ca",
+			ByDefault: "root-ca.crt",
+		},
+		{
+			Name:      "responder",
+			Usage:     "OCSP responder URL, by default the one included in the certificate",
+			FlagKey:   "status.responder",
+			ByDefault: "",
+		},
+	}
+	if err := cli.SetupCommandParams(statusCmd, params); err != nil {
+		panic(err)
+	}
+	rootCmd.AddCommand(statusCmd)
+}
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Limits for the metadata included in enrollment requests.
+const (
+	maxMetadataEntries = 16
+	maxMetadataValue   = 256
+)
+
+var metadataKey = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// Values available to subject templates:
+// - .DID: the subject's DID
+// - .Document: the resolved DID document, including custom properties
+// - .Metadata: the metadata included in the enrollment request
+// Templates must produce a JSON certificate request; values provided by
+// users should be inserted using the 'json' function so they are properly
+// escaped. Metadata is self-asserted by users, so it must only be used for
+// subject attributes when restricted to the values allowed by the operator
+// with 'oneOf', e.g. '"ou": {{json (oneOf .Metadata.cohort "a" "b")}}'. The
+// DID is always included in the certificate as a URI SAN, regardless of
+// the template used.
+type subjectData struct {
+	DID      string
+	Document map[string]interface{}
+	Metadata map[string]string
+}
+
+var subjectFuncs = template.FuncMap{
+	"json":    templateJSON,
+	"default": templateDefault,
+	"oneOf":   templateOneOf,
+	"service": templateService,
+}
+
+// Encode a value as JSON.
+func templateJSON(v interface{}) (string, error) {
+	js, err := json.Marshal(v)
+	return string(js), err
+}
+
+// Return the value, or 'def' if empty.
+func templateDefault(def, v interface{}) interface{} {
+	if v == nil || fmt.Sprintf("%v", v) == "" {
+		return def
+	}
+	return v
+}
+
+// Return the value if it's one of the allowed ones, fails otherwise. Empty
+// values are always allowed.
+func templateOneOf(v string, allowed ...string) (string, error) {
+	if v == "" {
+		return v, nil
+	}
+	for _, a := range allowed {
+		if v == a {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("value not allowed: %s", v)
+}
+
+// Return the endpoint for the first service in the DID document with the
+// provided type or id fragment, an empty string if not found.
+func templateService(doc map[string]interface{}, name string) string {
+	list, _ := doc["service"].([]interface{})
+	for _, el := range list {
+		s, ok := el.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		id, _ := s["id"].(string)
+		kind, _ := s["type"].(string)
+		if kind == name || strings.HasSuffix(id, "#"+name) {
+			endpoint, _ := s["serviceEndpoint"].(string)
+			return endpoint
+		}
+	}
+	return ""
+}
+
+// Return the subject template for the profile, loaded from the file set
+// in 'subject_template' or the built-in one by default. Templates are
+// validated when first loaded.
+func (p *signingProfile) subjectTemplate() (*template.Template, error) {
+	if p.tpl != nil {
+		return p.tpl, nil
+	}
+	src := defaultSubjectTemplate
+	if p.SubjectTemplate != "" {
+		contents, err := ioutil.ReadFile(p.SubjectTemplate)
+		if err != nil {
+			return nil, err
+		}
+		src = string(contents)
+	}
+	tpl, err := template.New("subject").Funcs(subjectFuncs).Option("missingkey=zero").Parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	// Render the template with sample values
+	sample := &subjectData{
+		DID:      "did:example:subject-template",
+		Document: map[string]interface{}{"id": "did:example:subject-template"},
+		Metadata: map[string]string{},
+	}
+	req, err := renderSubject(tpl, sample)
+	if err != nil {
+		return nil, err
+	}
+	if req.Key == nil {
+		return nil, errors.New("the subject template must include the key specification")
+	}
+	p.tpl = tpl
+	p.key = req.Key
+	return tpl, nil
+}
+
+// Return the key specification required for certificate requests
+// processed with the profile.
+func (p *signingProfile) keySpec() (*csrKey, error) {
+	if _, err := p.subjectTemplate(); err != nil {
+		return nil, err
+	}
+	return p.key, nil
+}
+
+// Produce a certificate request using the subject template.
+func renderSubject(tpl *template.Template, data *subjectData) (*csrRequest, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := tpl.Execute(buf, data); err != nil {
+		return nil, err
+	}
+	req, err := decodeCSRRequest(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("invalid subject template output: %s", err)
+	}
+	return req, nil
+}
+
+// Verify the metadata provided in an enrollment request.
+func validateMetadata(md map[string]string) error {
+	if len(md) > maxMetadataEntries {
+		return fmt.Errorf("metadata can't include more than %d entries", maxMetadataEntries)
+	}
+	for k, v := range md {
+		if !metadataKey.MatchString(k) {
+			return fmt.Errorf("invalid metadata key: %s", k)
+		}
+		if len(v) > maxMetadataValue {
+			return fmt.Errorf("metadata value for '%s' is too long", k)
+		}
+	}
+	return nil
+}
+
+// Parse metadata provided as a list of comma-separated 'key=value' pairs.
+func parseMetadata(value string) (map[string]string, error) {
+	md := make(map[string]string)
+	if value == "" {
+		return md, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid metadata entry: %s", pair)
+		}
+		md[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return md, validateMetadata(md)
+}
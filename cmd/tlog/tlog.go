@@ -0,0 +1,213 @@
+// Package tlog provides the Merkle tree operations used by the issuance
+// transparency log. Hashing, audit paths and consistency proofs follow the
+// definitions in RFC 6962, verification the algorithms in RFC 9162.
+package tlog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Domain separation prefixes for leaf and interior node hashes.
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// LeafHash returns the hash for a log entry.
+func LeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// NodeHash returns the hash for an interior node with the provided children.
+func NodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// RootHash returns the Merkle tree hash for the provided leaf hashes.
+func RootHash(leaves [][]byte) []byte {
+	switch n := len(leaves); n {
+	case 0:
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	case 1:
+		return leaves[0]
+	default:
+		k := split(n)
+		return NodeHash(RootHash(leaves[:k]), RootHash(leaves[k:]))
+	}
+}
+
+// InclusionProof returns the audit path for the leaf at 'index' in the
+// tree formed by the provided leaf hashes.
+func InclusionProof(leaves [][]byte, index int) ([][]byte, error) {
+	if index < 0 || index >= len(leaves) {
+		return nil, fmt.Errorf("invalid leaf index %d for tree size %d", index, len(leaves))
+	}
+	return path(index, leaves), nil
+}
+
+// ConsistencyProof returns the proof that the tree formed by the first
+// 'size' leaves is a prefix of the tree formed by all the provided leaves.
+func ConsistencyProof(leaves [][]byte, size int) ([][]byte, error) {
+	if size <= 0 || size > len(leaves) {
+		return nil, fmt.Errorf("invalid tree size %d for current size %d", size, len(leaves))
+	}
+	return subproof(size, leaves, true), nil
+}
+
+// VerifyInclusion checks the audit path proves the leaf is included at
+// 'index' in the tree of the provided size and root hash.
+func VerifyInclusion(index, size uint64, leaf []byte, proof [][]byte, root []byte) error {
+	if index >= size {
+		return fmt.Errorf("invalid leaf index %d for tree size %d", index, size)
+	}
+	fn, sn, r := index, size-1, leaf
+	for _, p := range proof {
+		if sn == 0 {
+			return errors.New("inclusion proof is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			r = NodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = NodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return errors.New("inclusion proof is too short")
+	}
+	if !bytes.Equal(r, root) {
+		return errors.New("inclusion proof doesn't match the root hash")
+	}
+	return nil
+}
+
+// VerifyConsistency checks the proof shows the tree with size 'first' and
+// root hash 'firstRoot' is a prefix of the tree with size 'second' and root
+// hash 'secondRoot'.
+func VerifyConsistency(first, second uint64, firstRoot, secondRoot []byte, proof [][]byte) error {
+	switch {
+	case first == 0 || first > second:
+		return fmt.Errorf("invalid tree sizes %d and %d", first, second)
+	case first == second:
+		if len(proof) != 0 {
+			return errors.New("consistency proof must be empty for trees of the same size")
+		}
+		if !bytes.Equal(firstRoot, secondRoot) {
+			return errors.New("root hashes don't match for trees of the same size")
+		}
+		return nil
+	case len(proof) == 0:
+		return errors.New("empty consistency proof")
+	}
+
+	// When the first tree is complete its root is the starting node
+	if first&(first-1) == 0 {
+		proof = append([][]byte{firstRoot}, proof...)
+	}
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return errors.New("consistency proof is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = NodeHash(c, fr)
+			sr = NodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = NodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return errors.New("consistency proof is too short")
+	}
+	if !bytes.Equal(fr, firstRoot) || !bytes.Equal(sr, secondRoot) {
+		return errors.New("consistency proof doesn't match the root hashes")
+	}
+	return nil
+}
+
+// TreeHead describes the state of the log at a given time. Tree heads are
+// signed by the log operator, committing to the contents of the log.
+type TreeHead struct {
+	Size      uint64 `json:"tree_size"`
+	Timestamp int64  `json:"timestamp"`
+	Root      []byte `json:"root_hash"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// Digest returns the SHA-256 digest signed for the tree head.
+func (th *TreeHead) Digest() []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[:8], th.Size)
+	binary.BigEndian.PutUint64(buf[8:], uint64(th.Timestamp))
+	h := sha256.New()
+	h.Write([]byte("suss-workshop/tlog:"))
+	h.Write(buf)
+	h.Write(th.Root)
+	return h.Sum(nil)
+}
+
+// Largest power of two smaller than n, n must be greater than 1.
+func split(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// Audit path for the leaf at index m, PATH(m, D[n]) in RFC 6962.
+func path(m int, leaves [][]byte) [][]byte {
+	n := len(leaves)
+	if n == 1 {
+		return nil
+	}
+	k := split(n)
+	if m < k {
+		return append(path(m, leaves[:k]), RootHash(leaves[k:]))
+	}
+	return append(path(m-k, leaves[k:]), RootHash(leaves[:k]))
+}
+
+// Consistency proof for the first m leaves, SUBPROOF(m, D[n], b) in RFC 6962.
+func subproof(m int, leaves [][]byte, complete bool) [][]byte {
+	n := len(leaves)
+	if m == n {
+		if complete {
+			return nil
+		}
+		return [][]byte{RootHash(leaves)}
+	}
+	k := split(n)
+	if m <= k {
+		return append(subproof(m, leaves[:k], complete), RootHash(leaves[k:]))
+	}
+	return append(subproof(m-k, leaves[k:], false), RootHash(leaves[:k]))
+}
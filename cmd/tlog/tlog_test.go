@@ -0,0 +1,273 @@
+package tlog
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// Test vectors from the certificate-transparency reference implementation.
+var testInputs = []string{
+	"",
+	"00",
+	"10",
+	"2021",
+	"3031",
+	"40414243",
+	"5051525354555657",
+	"606162636465666768696a6b6c6d6e6f",
+}
+
+// Root hashes for the trees formed by the first 1 to 8 test inputs.
+var testRoots = []string{
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+func testLeaves(t *testing.T, n int) [][]byte {
+	t.Helper()
+	var leaves [][]byte
+	for _, v := range testInputs[:n] {
+		data, err := hex.DecodeString(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves = append(leaves, LeafHash(data))
+	}
+	return leaves
+}
+
+// Leaves for trees larger than the test vectors.
+func generatedLeaves(n int) [][]byte {
+	var leaves [][]byte
+	for i := 0; i < n; i++ {
+		leaves = append(leaves, LeafHash([]byte(fmt.Sprintf("entry-%d", i))))
+	}
+	return leaves
+}
+
+func decodeHashes(t *testing.T, values ...string) [][]byte {
+	t.Helper()
+	var list [][]byte
+	for _, v := range values {
+		h, err := hex.DecodeString(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, h)
+	}
+	return list
+}
+
+func equalHashes(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRootHash(t *testing.T) {
+	empty := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	if got := hex.EncodeToString(RootHash(nil)); got != empty {
+		t.Errorf("empty tree: %s", got)
+	}
+	for i, expected := range testRoots {
+		if got := hex.EncodeToString(RootHash(testLeaves(t, i+1))); got != expected {
+			t.Errorf("size %d: %s != %s", i+1, got, expected)
+		}
+	}
+}
+
+func TestInclusionProof(t *testing.T) {
+	cases := []struct {
+		index, size int
+		proof       []string
+	}{
+		{0, 1, nil},
+		{0, 8, []string{
+			"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+		}},
+		{5, 8, []string{
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+			"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+			"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		}},
+		{2, 3, []string{
+			"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+		}},
+		{1, 5, []string{
+			"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		}},
+	}
+	for _, tc := range cases {
+		leaves := testLeaves(t, tc.size)
+		proof, err := InclusionProof(leaves, tc.index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalHashes(proof, decodeHashes(t, tc.proof...)) {
+			t.Errorf("index %d, size %d: unexpected proof", tc.index, tc.size)
+		}
+		root := RootHash(leaves)
+		if err = VerifyInclusion(uint64(tc.index), uint64(tc.size), leaves[tc.index], proof, root); err != nil {
+			t.Errorf("index %d, size %d: %s", tc.index, tc.size, err)
+		}
+	}
+
+	// Invalid indexes
+	leaves := testLeaves(t, 3)
+	for _, index := range []int{-1, 3} {
+		if _, err := InclusionProof(leaves, index); err == nil {
+			t.Errorf("proof produced for invalid index %d", index)
+		}
+	}
+}
+
+func TestVerifyInclusion(t *testing.T) {
+	for size := 1; size <= 33; size++ {
+		leaves := generatedLeaves(size)
+		root := RootHash(leaves)
+		for index := 0; index < size; index++ {
+			proof, err := InclusionProof(leaves, index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			i, n := uint64(index), uint64(size)
+			if err = VerifyInclusion(i, n, leaves[index], proof, root); err != nil {
+				t.Fatalf("index %d, size %d: %s", index, size, err)
+			}
+
+			// Wrong leaf, index, tree size and root
+			other := LeafHash([]byte("other"))
+			if VerifyInclusion(i, n, other, proof, root) == nil {
+				t.Errorf("index %d, size %d: wrong leaf accepted", index, size)
+			}
+			if size > 1 && VerifyInclusion((i+1)%n, n, leaves[index], proof, root) == nil {
+				t.Errorf("index %d, size %d: wrong index accepted", index, size)
+			}
+			if VerifyInclusion(i, n+1, leaves[index], proof, RootHash(generatedLeaves(size+1))) == nil {
+				t.Errorf("index %d, size %d: proof accepted for a larger tree", index, size)
+			}
+			if VerifyInclusion(i, n, leaves[index], proof, other) == nil {
+				t.Errorf("index %d, size %d: wrong root accepted", index, size)
+			}
+
+			// Truncated and extended proofs
+			if len(proof) > 0 && VerifyInclusion(i, n, leaves[index], proof[:len(proof)-1], root) == nil {
+				t.Errorf("index %d, size %d: truncated proof accepted", index, size)
+			}
+			if VerifyInclusion(i, n, leaves[index], append(proof, other), root) == nil {
+				t.Errorf("index %d, size %d: extended proof accepted", index, size)
+			}
+		}
+	}
+	if VerifyInclusion(0, 0, LeafHash(nil), nil, nil) == nil {
+		t.Error("inclusion accepted for an empty tree")
+	}
+}
+
+func TestConsistencyProof(t *testing.T) {
+	cases := []struct {
+		first, second int
+		proof         []string
+	}{
+		{1, 1, nil},
+		{1, 8, []string{
+			"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+		}},
+		{6, 8, []string{
+			"0ebc5d3437fbe2db158b9f126a1d118e308181031d0a949f8dededebc558ef6a",
+			"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+			"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		}},
+		{2, 5, []string{
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		}},
+	}
+	for _, tc := range cases {
+		leaves := testLeaves(t, tc.second)
+		proof, err := ConsistencyProof(leaves, tc.first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalHashes(proof, decodeHashes(t, tc.proof...)) {
+			t.Errorf("sizes %d and %d: unexpected proof", tc.first, tc.second)
+		}
+		firstRoot, secondRoot := RootHash(leaves[:tc.first]), RootHash(leaves)
+		if err = VerifyConsistency(uint64(tc.first), uint64(tc.second), firstRoot, secondRoot, proof); err != nil {
+			t.Errorf("sizes %d and %d: %s", tc.first, tc.second, err)
+		}
+	}
+
+	// Invalid sizes
+	leaves := testLeaves(t, 3)
+	for _, size := range []int{0, 4} {
+		if _, err := ConsistencyProof(leaves, size); err == nil {
+			t.Errorf("proof produced for invalid size %d", size)
+		}
+	}
+}
+
+func TestVerifyConsistency(t *testing.T) {
+	leaves := generatedLeaves(34)
+	for second := 1; second < len(leaves); second++ {
+		secondRoot := RootHash(leaves[:second])
+		for first := 1; first <= second; first++ {
+			firstRoot := RootHash(leaves[:first])
+			proof, err := ConsistencyProof(leaves[:second], first)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, n := uint64(first), uint64(second)
+			if err = VerifyConsistency(m, n, firstRoot, secondRoot, proof); err != nil {
+				t.Fatalf("sizes %d and %d: %s", first, second, err)
+			}
+			if first == second {
+				continue
+			}
+
+			// Wrong roots, sizes and proofs
+			other := LeafHash([]byte("other"))
+			if VerifyConsistency(m, n, other, secondRoot, proof) == nil {
+				t.Errorf("sizes %d and %d: wrong first root accepted", first, second)
+			}
+			if VerifyConsistency(m, n, firstRoot, other, proof) == nil {
+				t.Errorf("sizes %d and %d: wrong second root accepted", first, second)
+			}
+			if VerifyConsistency(m, n+1, firstRoot, RootHash(leaves[:second+1]), proof) == nil {
+				t.Errorf("sizes %d and %d: proof accepted for a larger tree", first, second)
+			}
+			if VerifyConsistency(m, n, firstRoot, secondRoot, proof[:len(proof)-1]) == nil {
+				t.Errorf("sizes %d and %d: truncated proof accepted", first, second)
+			}
+			if VerifyConsistency(m, n, firstRoot, secondRoot, append(proof, other)) == nil {
+				t.Errorf("sizes %d and %d: extended proof accepted", first, second)
+			}
+		}
+	}
+	if VerifyConsistency(0, 1, nil, RootHash(leaves[:1]), nil) == nil {
+		t.Error("consistency accepted for an empty tree")
+	}
+	if VerifyConsistency(2, 1, RootHash(leaves[:2]), RootHash(leaves[:1]), nil) == nil {
+		t.Error("consistency accepted for a smaller second tree")
+	}
+}
@@ -0,0 +1,279 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aidtechnology/suss-workshop/cmd/tlog"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Every issued certificate is appended to an append-only Merkle tree log,
+// so users can audit the certificates issued by the CA. Entries are the
+// DER-encoded certificates, keyed by their position in the log.
+
+// Inclusion proof for a log entry.
+type inclusionProof struct {
+	Index uint64   `json:"leaf_index"`
+	Size  uint64   `json:"tree_size"`
+	Proof [][]byte `json:"proof"`
+}
+
+// Consistency proof between two versions of the log.
+type consistencyProof struct {
+	First  uint64   `json:"first"`
+	Second uint64   `json:"second"`
+	Proof  [][]byte `json:"proof"`
+}
+
+func appendLogEntry(tx *bolt.Tx, data []byte) error {
+	b := tx.Bucket(logBucket)
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq-1)
+	return b.Put(key, data)
+}
+
+// Append to the log the certificates in the registry that are missing from
+// it, such as those issued before the log was introduced. Certificates are
+// appended in issuance order; returns the number of entries added.
+func (cr *certRegistry) backfillLog() (int, error) {
+	db, err := cr.open()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	count := 0
+	err = db.Update(func(tx *bolt.Tx) error {
+		logged := make(map[string]bool)
+		err := tx.Bucket(logBucket).ForEach(func(_, v []byte) error {
+			logged[hex.EncodeToString(tlog.LeafHash(v))] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		var records []*certRecord
+		err = tx.Bucket(certsBucket).ForEach(func(_, v []byte) error {
+			rec := &certRecord{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				return err
+			}
+			records = append(records, rec)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Slice(records, func(i, j int) bool {
+			return records[i].IssuedAt.Before(records[j].IssuedAt)
+		})
+		for _, rec := range records {
+			cert, err := parseCertificate(rec.Cert)
+			if err != nil {
+				return fmt.Errorf("%s: %s", rec.Serial, err)
+			}
+			if logged[hex.EncodeToString(tlog.LeafHash(cert.Raw))] {
+				continue
+			}
+			if err = appendLogEntry(tx, cert.Raw); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Return the leaf hashes for all the entries in the log, in order.
+func (cr *certRegistry) logLeaves() ([][]byte, error) {
+	var leaves [][]byte
+	err := cr.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(logBucket).ForEach(func(_, v []byte) error {
+			leaves = append(leaves, tlog.LeafHash(v))
+			return nil
+		})
+	})
+	return leaves, err
+}
+
+// Return a tree head for the current state of the log, signed by the CA.
+func signTreeHead(ca *authority, leaves [][]byte) (*tlog.TreeHead, error) {
+	th := &tlog.TreeHead{
+		Size:      uint64(len(leaves)),
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Root:      tlog.RootHash(leaves),
+	}
+	sig, err := ca.key.Sign(rand.Reader, th.Digest(), crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	th.Signature = sig
+	return th, nil
+}
+
+// Log head
+// Return the signed tree head for the current state of the log.
+func logHeadHandler(ca *authority, reg *certRegistry) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		r := &serviceResponse{
+			Ok:       false,
+			Response: "",
+		}
+		leaves, err := reg.logLeaves()
+		if err != nil {
+			res.WriteHeader(500)
+			r.Response = "failed to read the log"
+			res.Write(r.encode())
+			return
+		}
+		th, err := signTreeHead(ca, leaves)
+		if err != nil {
+			res.WriteHeader(500)
+			r.Response = "failed to sign the tree head"
+			res.Write(r.encode())
+			return
+		}
+		r.Ok = true
+		r.Response = th
+		res.Write(r.encode())
+	}
+}
+
+// Inclusion proof
+// Return the audit path for an entry, the following query parameters are
+// supported:
+// - hash: hex-encoded leaf hash for the entry
+// - size: size of the tree to use, by default the current size of the log
+func logInclusionHandler(reg *certRegistry) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		r := &serviceResponse{
+			Ok:       false,
+			Response: "",
+		}
+		leaf, err := hex.DecodeString(req.URL.Query().Get("hash"))
+		if err != nil || len(leaf) == 0 {
+			res.WriteHeader(400)
+			r.Response = "invalid leaf hash"
+			res.Write(r.encode())
+			return
+		}
+		leaves, err := reg.logLeaves()
+		if err != nil {
+			res.WriteHeader(500)
+			r.Response = "failed to read the log"
+			res.Write(r.encode())
+			return
+		}
+		size, err := treeSize(req.URL.Query().Get("size"), len(leaves))
+		if err != nil {
+			res.WriteHeader(400)
+			r.Response = "invalid tree size"
+			res.Write(r.encode())
+			return
+		}
+		leaves = leaves[:size]
+		for i, h := range leaves {
+			if !bytes.Equal(h, leaf) {
+				continue
+			}
+			proof, err := tlog.InclusionProof(leaves, i)
+			if err != nil {
+				res.WriteHeader(500)
+				r.Response = err.Error()
+				res.Write(r.encode())
+				return
+			}
+			r.Ok = true
+			r.Response = &inclusionProof{
+				Index: uint64(i),
+				Size:  uint64(size),
+				Proof: proof,
+			}
+			res.Write(r.encode())
+			return
+		}
+		res.WriteHeader(404)
+		r.Response = "entry not found in the log"
+		res.Write(r.encode())
+	}
+}
+
+// Consistency proof
+// Return the proof that a previous version of the log is a prefix of a
+// later one, the following query parameters are supported:
+// - first: size of the previous version of the log
+// - second: size of the later version, by default the current size of the log
+func logConsistencyHandler(reg *certRegistry) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		r := &serviceResponse{
+			Ok:       false,
+			Response: "",
+		}
+		leaves, err := reg.logLeaves()
+		if err != nil {
+			res.WriteHeader(500)
+			r.Response = "failed to read the log"
+			res.Write(r.encode())
+			return
+		}
+		second, err := treeSize(req.URL.Query().Get("second"), len(leaves))
+		if err != nil {
+			res.WriteHeader(400)
+			r.Response = "invalid tree size"
+			res.Write(r.encode())
+			return
+		}
+		first, err := treeSize(req.URL.Query().Get("first"), second)
+		if err != nil || first == 0 {
+			res.WriteHeader(400)
+			r.Response = "invalid tree size"
+			res.Write(r.encode())
+			return
+		}
+		proof, err := tlog.ConsistencyProof(leaves[:second], first)
+		if err != nil {
+			res.WriteHeader(400)
+			r.Response = err.Error()
+			res.Write(r.encode())
+			return
+		}
+		r.Ok = true
+		r.Response = &consistencyProof{
+			First:  uint64(first),
+			Second: uint64(second),
+			Proof:  proof,
+		}
+		res.Write(r.encode())
+	}
+}
+
+// Parse a tree size parameter, it can't be larger than 'max' and defaults
+// to it when not provided.
+func treeSize(value string, max int) (int, error) {
+	if value == "" {
+		return max, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 0 || size > max {
+		return 0, errors.New("invalid tree size")
+	}
+	return size, nil
+}
@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/logrusorgru/aurora"
+)
+
+// Default trust anchor for the service's certificate, used along with the
+// system pool when available.
+const defaultTrustAnchor = "root-ca.crt"
+
+// Settings used to verify the identity of the service.
+type serverTrust struct {
+	// CA certificate(s) file, when empty the system pool is used along
+	// with 'root-ca.crt' if present.
+	ca string
+
+	// Expected fingerprint for the server's public key, in the form
+	// 'sha256/<base64 value>'.
+	pin string
+
+	// File used to record server key fingerprints on first use.
+	knownHosts string
+}
+
+// Return a TLS configuration that verifies the server's certificate
+// against the configured trust anchors. When enabled, the server key
+// must also match the pinned or previously recorded fingerprint.
+func (st *serverTrust) config(host string) (*tls.Config, error) {
+	pool, err := st.pool()
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+	if st.pin == "" && st.knownHosts == "" {
+		return conf, nil
+	}
+	conf.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+		if len(chains) == 0 || len(chains[0]) == 0 {
+			return errors.New("no verified certificate chain")
+		}
+		fp := keyFingerprint(chains[0][0])
+		if st.pin != "" {
+			if !pinMatches(st.pin, chains) {
+				return fmt.Errorf("server key doesn't match the pinned value, got: %s", fp)
+			}
+		}
+		if st.knownHosts != "" {
+			return st.checkKnownHost(host, fp)
+		}
+		return nil
+	}
+	return conf, nil
+}
+
+// Load the certificate pool used to verify the server.
+func (st *serverTrust) pool() (*x509.CertPool, error) {
+	if st.ca != "" {
+		pem, err := ioutil.ReadFile(st.ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificates found in: %s", st.ca)
+		}
+		return pool, nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if pem, err := ioutil.ReadFile(defaultTrustAnchor); err == nil {
+		pool.AppendCertsFromPEM(pem)
+	}
+	return pool, nil
+}
+
+// Trust-on-first-use verification. The first time a host is seen its
+// key fingerprint is recorded; afterwards, a different key is rejected.
+func (st *serverTrust) checkKnownHost(host, fp string) error {
+	known, err := readKnownHosts(st.knownHosts)
+	if err != nil {
+		return err
+	}
+	prev, ok := known[host]
+	if !ok {
+		fmt.Fprintln(os.Stderr, aurora.Yellow(fmt.Sprintf("new host '%s' with key %s, adding it to known hosts", host, fp)))
+		return appendKnownHost(st.knownHosts, host, fp)
+	}
+	if prev != fp {
+		warning := []string{
+			"@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@",
+			"@    WARNING: THE SERVER KEY HAS CHANGED!                 @",
+			"@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@",
+			"Someone could be intercepting your connection, or the server key was rotated.",
+			fmt.Sprintf("host:     %s", host),
+			fmt.Sprintf("expected: %s", prev),
+			fmt.Sprintf("received: %s", fp),
+			fmt.Sprintf("If the change is legitimate remove the entry for the host from: %s", st.knownHosts),
+		}
+		fmt.Fprintln(os.Stderr, aurora.Red(strings.Join(warning, "\n")))
+		return errors.New("server key verification failed")
+	}
+	return nil
+}
+
+// SHA-256 fingerprint of the certificate's public key.
+func keyFingerprint(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// A pin is satisfied by any certificate on the verified chains.
+func pinMatches(pin string, chains [][]*x509.Certificate) bool {
+	for _, chain := range chains {
+		for _, c := range chain {
+			if keyFingerprint(c) == pin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Known hosts entries use the format '<host> <fingerprint>', one per line.
+func readKnownHosts(file string) (map[string]string, error) {
+	known := make(map[string]string)
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return known, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		known[fields[0]] = fields[1]
+	}
+	return known, scanner.Err()
+}
+
+func appendKnownHost(file, host, fp string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s %s\n", host, fp)
+	return err
+}
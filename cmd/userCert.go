@@ -1,11 +1,14 @@
 package cmd
 
 import (
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io/ioutil"
 
+	"github.com/bryk-io/x/cli"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var userCertCmd = &cobra.Command{
@@ -21,6 +24,13 @@ var userCertCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
+		req, err := decodeCSRRequest(csrJSON)
+		if err != nil {
+			return err
+		}
+		if req.Key == nil {
+			return errors.New("the CSR must include the key specification")
+		}
 
 		// Start CA instance
 		ca, err := getCA()
@@ -29,16 +39,39 @@ var userCertCmd = &cobra.Command{
 		}
 
 		// Sign user certificate
-		cert, key, err := ca.SignRequestJSON(csrJSON, "user")
+		profile := viper.GetString("user-cert.profile")
+		key, err := generateKey(req.Key)
+		if err != nil {
+			return err
+		}
+		cert, err := ca.signCSR(&x509.CertificateRequest{PublicKey: key.Public()}, req, profile)
+		if err != nil {
+			return err
+		}
+		keyPEM, err := encodePrivateKey(key)
 		if err != nil {
 			return err
 		}
 
-		// Save client certificate
-		if err = ioutil.WriteFile("user.crt", cert, 0400); err != nil {
+		// Register certificate
+		reg, err := openRegistry(viper.GetString("ca.registry"))
+		if err != nil {
+			return err
+		}
+		issued, err := parseCertificate(cert)
+		if err != nil {
+			return err
+		}
+		if err = reg.record(issued, cert, profile, sourceUserCert, nil); err != nil {
+			return err
+		}
+
+		// Save client certificate, along with the CA chain
+		out := viper.GetString("user-cert.output")
+		if err = writeOutput(out, "user.crt", ca.bundle(cert)); err != nil {
 			return err
 		}
-		if err = ioutil.WriteFile("user.pem", key, 0400); err != nil {
+		if err = writeOutput(out, "user.pem", keyPEM); err != nil {
 			return err
 		}
 		fmt.Println("user certificate created")
@@ -47,5 +80,22 @@ var userCertCmd = &cobra.Command{
 }
 
 func init() {
+	params := []cli.Param{
+		{
+			Name:      "profile",
+			Usage:     "signing profile to use for the certificate",
+			FlagKey:   "user-cert.profile",
+			ByDefault: "user",
+		},
+		{
+			Name:      "output",
+			Usage:     "directory to store the generated certificate and private key",
+			FlagKey:   "user-cert.output",
+			ByDefault: ".",
+		},
+	}
+	if err := cli.SetupCommandParams(userCertCmd, params); err != nil {
+		panic(err)
+	}
 	rootCmd.AddCommand(userCertCmd)
 }
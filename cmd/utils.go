@@ -1,89 +1,278 @@
 package cmd
 
 import (
+	"crypto"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"net/http"
-	"text/template"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/bryk-io/x/did"
-	"github.com/bryk-io/x/pki"
+	"github.com/spf13/viper"
 )
 
-var tplUserCSR *template.Template
+// File names for the intermediate CA material created by 'intermediate-ca'.
+const (
+	defaultIntermediateCert = "intermediate-ca.crt"
+	defaultIntermediateKey  = "intermediate-ca.pem"
+)
 
-func init() {
-	tplUserCSR, _ = template.New("csr").Parse(`{
+// Subject template used for profiles without a 'subject_template' file.
+const defaultSubjectTemplate = `{
   "cn": "{{.DID}}",
-  "hosts": [
-    "{{.DID}}"
-  ],
   "key": {
     "algo": "ecdsa",
     "size": 521
-  },
-  "names": [
-    {
-      "o": "Singapore University of Social Sciences",
-      "sa": "463 Clementi Road",
-      "st": "Singapore",
-      "pc": "599494",
-      "c": "SG"
-    }
-  ]
-}`)
-}
+  }
+}`
+
+// Prefix for CA material provided directly as base64-encoded values.
+const base64Prefix = "base64:"
 
-func getCA() (*pki.CA, error) {
-	confJSON, err := ioutil.ReadFile("ca_conf.json")
+// Prefix for CA keys stored in a PKCS#11 token, the key is identified by
+// its label using the 'object' attribute from RFC 7512, for example:
+// 'pkcs11:object=suss-root-ca'.
+const pkcs11Prefix = "pkcs11:"
+
+// Return the CA used to issue user certificates. When an intermediate CA
+// is configured it's used instead of the root CA, so the root key is not
+// required on the online server.
+func getCA() (*authority, error) {
+	conf, err := readCAConfig()
 	if err != nil {
-		return nil, errors.New("failed to read CA configuration file 'ca_conf.json'")
+		return nil, err
 	}
-	conf, err := pki.DecodeConfig(confJSON)
+	root, cert, key := caLocations()
+	if key == "" {
+		return nil, errors.New("no location provided for the CA private key")
+	}
+	ca, err := loadAuthority(conf, root, cert, key)
 	if err != nil {
 		return nil, err
 	}
-	return pki.NewCA("root-ca.crt", "root-ca.pem", nil, conf)
+	if err = withTrustBundle(ca); err != nil {
+		return nil, err
+	}
+	return ca, nil
 }
 
-func resolveDID(value string) (*did.Identifier, error) {
-	// Verify the provided value is a valid DID string
-	d, err := did.Parse(value)
+// Return the CA used to issue user certificates without loading its
+// private key, suitable only to verify certificates.
+func getVerifierCA() (*authority, error) {
+	conf, err := readCAConfig()
 	if err != nil {
 		return nil, err
 	}
-	if d.Method() != "bryk" {
-		return nil, errors.New("only the 'bryk' DID method is supported for this application")
+	root, cert, _ := caLocations()
+	ca, err := loadAuthority(conf, root, cert, "")
+	if err != nil {
+		return nil, err
 	}
+	if err = withTrustBundle(ca); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
 
-	// Retrieve element
-	res, err := http.Get(fmt.Sprintf("https://did.bryk.io/v1/retrieve?subject=%s", d.Subject()))
+// Load the trust bundle for the CA, if one is configured.
+func withTrustBundle(ca *authority) error {
+	if bundle := viper.GetString("ca.trust-bundle"); bundle != "" {
+		return ca.loadTrustBundle(bundle)
+	}
+	return nil
+}
+
+// Locations for the root certificate, signing certificate and signing key.
+// The signing CA must be configured explicitly with 'ca.cert' and 'ca.key',
+// otherwise the root CA is used.
+func caLocations() (root, cert, key string) {
+	root = viper.GetString("ca.root")
+	cert, key = viper.GetString("ca.cert"), viper.GetString("ca.key")
+	if cert == "" {
+		cert, key = root, viper.GetString("ca.root-key")
+	}
+	return
+}
+
+// Return the root CA, used to issue intermediate CAs.
+func getRootCA() (*authority, error) {
+	conf, err := readCAConfig()
 	if err != nil {
 		return nil, err
 	}
-	defer res.Body.Close()
+	root, key := viper.GetString("ca.root"), viper.GetString("ca.root-key")
+	if key == "" {
+		return nil, errors.New("no location provided for the CA private key")
+	}
+	return loadAuthority(conf, root, root, key)
+}
 
-	// Parse document
-	docJSON, err := ioutil.ReadAll(res.Body)
+func readCAConfig() (*caConfig, error) {
+	confJSON, err := readMaterial(viper.GetString("ca.config"))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to read CA configuration: %s", err)
+	}
+	return decodeCAConfig(confJSON)
+}
+
+// Load CA material from a file, such as a mounted secret, or directly from
+// the value when using the 'base64:' prefix, useful for env variables.
+func readMaterial(value string) ([]byte, error) {
+	if value == "" {
+		return nil, errors.New("no location provided")
+	}
+	if strings.HasPrefix(value, base64Prefix) {
+		data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, base64Prefix))
+		if err != nil {
+			return nil, errors.New("invalid base64 value")
+		}
+		return data, nil
+	}
+	return ioutil.ReadFile(value)
+}
+
+// Load a CA private key from a file, a base64 value or a PKCS#11 token.
+func loadCAKey(location string) (crypto.Signer, error) {
+	if label, ok := pkcs11Label(location); ok {
+		return openPKCS11Key(label)
+	}
+	keyPEM, err := readMaterial(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA private key: %s", err)
+	}
+	return unlockCAKey(keyPEM)
+}
+
+// Return the key label if the location refers to a PKCS#11 token.
+func pkcs11Label(location string) (string, bool) {
+	if !strings.HasPrefix(location, pkcs11Prefix) {
+		return "", false
+	}
+	for _, attr := range strings.Split(strings.TrimPrefix(location, pkcs11Prefix), ";") {
+		if strings.HasPrefix(attr, "object=") {
+			label, err := url.PathUnescape(strings.TrimPrefix(attr, "object="))
+			return label, err == nil && label != ""
+		}
+	}
+	return "", false
+}
+
+// Write a file in the provided output directory, creating it if required.
+func writeOutput(dir, name string, data []byte) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name), data, 0400)
+}
+
+// Atomically replace the contents of a file, this works even when the
+// existing file is read-only.
+func replaceFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".renew")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// Resolve the DID, also returning the raw contents of its document.
+func resolveDocument(r Resolver, value string) (*did.Identifier, map[string]interface{}, error) {
+	// Verify the provided value is a valid DID string
+	d, err := did.Parse(value)
+	if err != nil {
+		return nil, nil, err
 	}
+
+	// Retrieve element
+	docJSON, err := r.Resolve(d)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Parse document
 	doc := &did.Document{}
 	if err = json.Unmarshal(docJSON, doc); err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	raw := make(map[string]interface{})
+	if err = json.Unmarshal(docJSON, &raw); err != nil {
+		return nil, nil, err
+	}
+	id, err := did.FromDocument(doc)
+	if err != nil {
+		return nil, nil, err
 	}
-	return did.FromDocument(doc)
+
+	// The document must belong to the requested DID
+	if id.String() != d.String() {
+		return nil, nil, fmt.Errorf("the document retrieved is for %s, not %s", id.String(), d.String())
+	}
+	return id, raw, nil
 }
 
-func verifySignature(id *did.Identifier, challenge string, sig *did.SignatureLD) error {
-	masterKey := id.Key("master")
-	if masterKey == nil {
-		return errors.New("failed to retrieve master key for the DID")
+// Verify the challenge signature. The signature must be produced by a key
+// listed in the 'authentication' relationship of the DID document, or by
+// the 'master' key for 'did:bryk' identifiers.
+func verifySignature(id *did.Identifier, doc map[string]interface{}, challenge string, sig *did.SignatureLD) error {
+	if sig == nil {
+		return errors.New("missing signature")
+	}
+
+	// Use the key referenced as the signature's creator, 'master' by default
+	keyID := "master"
+	if sig.Creator != "" {
+		segs := strings.SplitN(sig.Creator, "#", 2)
+		if len(segs) != 2 || segs[0] != id.String() {
+			return errors.New("signature was not created by a key of the DID")
+		}
+		keyID = segs[1]
+	}
+	if !(id.Method() == "bryk" && keyID == "master") && !authenticationKeys(doc)[id.String()+"#"+keyID] {
+		return fmt.Errorf("key '%s' can't be used to authenticate the DID", keyID)
 	}
-	if !masterKey.VerifySignatureLD([]byte(challenge), sig) {
+	key := id.Key(keyID)
+	if key == nil {
+		return fmt.Errorf("failed to retrieve key '%s' for the DID", keyID)
+	}
+	if !key.VerifySignatureLD([]byte(challenge), sig) {
 		return errors.New("invalid signature/challenge")
 	}
 	return nil
 }
+
+// Return the identifiers of the keys in the 'authentication' relationship
+// of the DID document. Entries can be references or embedded methods.
+func authenticationKeys(doc map[string]interface{}) map[string]bool {
+	id, _ := doc["id"].(string)
+	keys := make(map[string]bool)
+	list, _ := doc["authentication"].([]interface{})
+	for _, entry := range list {
+		kid, _ := entry.(string)
+		if m, ok := entry.(map[string]interface{}); ok {
+			kid, _ = m["id"].(string)
+		}
+		if kid != "" {
+			keys[absoluteKeyID(id, kid)] = true
+		}
+	}
+	return keys
+}
@@ -1,6 +1,6 @@
 module github.com/aidtechnology/suss-workshop
 
-go 1.12
+go 1.15
 
 require (
 	github.com/bryk-io/x v0.0.0-20190614052234-0398d942366b
@@ -14,8 +14,11 @@ require (
 	github.com/lib/pq v1.1.1 // indirect
 	github.com/logrusorgru/aurora v0.0.0-20190428105938-cea283e61946
 	github.com/mattn/go-sqlite3 v1.10.0 // indirect
+	github.com/miekg/pkcs11 v1.0.2
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/viper v1.4.0
+	go.etcd.io/bbolt v1.3.2
+	golang.org/x/crypto v0.0.0-20190513172903-22d7a77e9e5f
 )
 
 replace (
@@ -0,0 +1,17 @@
+{
+  "cn": "{{.DID}}",
+  "key": {
+    "algo": "ecdsa",
+    "size": 521
+  },
+  "names": [
+    {
+      "o": "Singapore University of Social Sciences",
+      "ou": {{json (oneOf .Metadata.cohort "workshop-2019a" "workshop-2019b")}},
+      "sa": "463 Clementi Road",
+      "st": "Singapore",
+      "pc": "599494",
+      "c": "SG"
+    }
+  ]
+}